@@ -3,7 +3,9 @@
 package client
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
 )
 
 const DefaultAddress = "192.168.8.46:8080"
@@ -49,21 +52,30 @@ func (l *Listener) ProcessStop() bool {
 	return false
 }
 
-type ModelYear int64
+// ModelYear is the car model year, see protocol.ModelYear.
+type ModelYear = protocol.ModelYear
 
 const (
-	ModelYearUnknown ModelYear = iota
-	ModelYear14
-	ModelYear18
-	ModelYear24
+	ModelYearUnknown = protocol.ModelYearUnknown
+	ModelYear14      = protocol.ModelYear14
+	ModelYear18      = protocol.ModelYear18
+	ModelYear24      = protocol.ModelYear24
 )
 
+// ParseModelYear parses a model year, e.g "MY18" or "18".
+func ParseModelYear(s string) (ModelYear, error) {
+	return protocol.ParseModelYear(s)
+}
+
 // A Client is a TCP client to a Phev.
 type Client struct {
 	// Recv is a channel where incoming messages from the Phev are sent.
 	Recv chan *protocol.PhevMessage
 	// Send is a channel to send messages to the Phev.
 	Send chan *protocol.PhevMessage
+	// Events has connection state changes. Events are dropped
+	// if not read.
+	Events chan ConnectionEvent
 
 	// Settings are settings for the car.
 	Settings *protocol.Settings
@@ -72,16 +84,33 @@ type Client struct {
 	lMu       sync.Mutex
 
 	address string
+
+	// Vehicle has the state received from the car.
+	Vehicle *vehicle.Vehicle
+
+	// ModelYear is the car model year, from its start request. It is
+	// set before the start request is sent on Recv and before the
+	// connection is established, so read it after either.
+	ModelYear ModelYear
+
+	// The connection state, guarded by sMu as the connection
+	// goroutines and Close change it.
+	state   ConnectionState
+	sMu     sync.Mutex
 	conn    net.Conn
+	closed  bool
 	lastRx  time.Time
 	started chan struct{}
+	// Closed when the current connection ends.
+	done chan struct{}
+	// Cancels Supervise, when running.
+	cancel context.CancelFunc
 
-	key *protocol.SecurityKey
+	supervised bool
+	minBackoff time.Duration
+	maxBackoff time.Duration
 
-	// Keep track of the model year so we can use the correct registers
-	ModelYear ModelYear
-
-	closed bool
+	stats stats
 }
 
 // An Option configures the client.
@@ -94,21 +123,54 @@ func AddressOption(address string) func(*Client) {
 	}
 }
 
+// VehicleOption configures the vehicle state to update, to keep
+// the state across clients.
+func VehicleOption(v *vehicle.Vehicle) func(*Client) {
+	return func(c *Client) {
+		c.Vehicle = v
+	}
+}
+
+// The shortest delay between reconnection attempts.
+const minBackoff = 10 * time.Millisecond
+
+// BackoffOption configures the minimum and maximum delay between
+// reconnection attempts when supervised. The minimum is at least
+// 10ms, and the maximum at least the minimum.
+func BackoffOption(min, max time.Duration) func(*Client) {
+	return func(c *Client) {
+		if min < minBackoff {
+			min = minBackoff
+		}
+		if max < min {
+			max = min
+		}
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
 // New returns a new client, not yet connected.
 func New(opts ...Option) (*Client, error) {
 	cl := &Client{
-		Recv:      make(chan *protocol.PhevMessage, 5),
-		Send:      make(chan *protocol.PhevMessage, 5),
-		Settings:  &protocol.Settings{},
-		started:   make(chan struct{}, 2),
-		listeners: []*Listener{},
-		address:   DefaultAddress,
-		key:       &protocol.SecurityKey{},
-		ModelYear: ModelYearUnknown,
+		Recv:       make(chan *protocol.PhevMessage, 5),
+		Send:       make(chan *protocol.PhevMessage, 5),
+		Events:     make(chan ConnectionEvent, 10),
+		Settings:   &protocol.Settings{},
+		started:    make(chan struct{}, 2),
+		listeners:  []*Listener{},
+		address:    DefaultAddress,
+		ModelYear:  ModelYearUnknown,
+		state:      StateDisconnected,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
 	}
 	for _, o := range opts {
 		o(cl)
 	}
+	if cl.Vehicle == nil {
+		cl.Vehicle = vehicle.New()
+	}
 	return cl, nil
 }
 
@@ -134,75 +196,144 @@ func (c *Client) RemoveListener(l *Listener) {
 	c.listeners = newL
 }
 
-// Close closes the client.
+// Close closes the client, and stops Supervise if running.
 func (c *Client) Close() error {
+	c.sMu.Lock()
+	cancel := c.cancel
+	c.sMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	err := c.closeConn()
+	c.setState(StateDisconnected, nil)
+	return err
+}
+
+func (c *Client) closeConn() error {
+	c.sMu.Lock()
 	c.closed = true
-	if c.conn == nil {
+	conn := c.conn
+	c.sMu.Unlock()
+	if conn == nil {
 		return nil
 	}
-	return c.conn.Close()
+	return conn.Close()
 }
 
+// Returns whether the connection was closed by the client.
+func (c *Client) isClosed() bool {
+	c.sMu.Lock()
+	defer c.sMu.Unlock()
+	return c.closed
+}
+
+// The model year of each start request.
+var startModelYears = map[byte]ModelYear{
+	protocol.CmdInMy14StartReq: ModelYear14,
+	protocol.CmdInMy18StartReq: ModelYear18,
+	protocol.CmdInMy24StartReq: ModelYear24,
+}
+
+// Sets the model year from a start request. The car sends these
+// again during the connection, and on each reconnection, so it is
+// only written on a change.
+func (c *Client) setModelYear(m *protocol.PhevMessage) {
+	if year, ok := startModelYears[m.Type]; ok && c.ModelYear != year {
+		c.ModelYear = year
+	}
+}
+
+var dialTimeout = 10 * time.Second
+
 // Connect connects to the Phev.
-func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.address)
+func (c *Client) Connect(ctx context.Context) error {
+	c.setState(StateConnecting, nil)
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.address)
 	if err != nil {
+		c.setState(StateDisconnected, err)
 		return err
 	}
 	log.Info("%PHEV_TCP_CONNECTED%")
+	key := &protocol.SecurityKey{}
+	started := make(chan struct{}, 2)
+	done := make(chan struct{})
+	// Drop messages left for an earlier connection.
+	for len(c.Send) > 0 {
+		<-c.Send
+	}
+	c.sMu.Lock()
 	c.closed = false
 	c.conn = conn
-	go c.reader()
-	go c.writer()
-	go c.manage()
-	go c.pinger()
+	c.started = started
+	c.done = done
+	c.sMu.Unlock()
+	c.setState(StateSecuring, nil)
+	go c.reader(conn, key, done)
+	go c.writer(conn, key, done)
+	go c.manage(started, done)
+	go c.pinger(done)
 
 	return nil
 }
 
 var startTimeout = 20 * time.Second
 
-// Start waits for the client to start.
-func (c *Client) Start() error {
+// Start waits for the client to start. If ctx has no deadline, a
+// default timeout applies.
+func (c *Client) Start(ctx context.Context) error {
 	log.Debug("%%PHEV_START_AWAIT%%")
-	startTimer := time.After(startTimeout)
-	for {
-		select {
-		case _, ok := <-c.started:
-			if !ok {
-				log.Debug("%%PHEV_START_CLOSED%%")
-				return fmt.Errorf("receiver closed before getting start request")
-			}
-			log.Debug("%%PHEV_START_DONE%%")
-		case <-startTimer:
-			log.Debug("%%PHEV_START_TIMEOUT%%")
-			return fmt.Errorf("timed out waiting for start")
+	ctx, cancel := withDefaultTimeout(ctx, startTimeout)
+	defer cancel()
+	c.sMu.Lock()
+	started := c.started
+	c.sMu.Unlock()
+	select {
+	case _, ok := <-started:
+		if !ok {
+			log.Debug("%%PHEV_START_CLOSED%%")
+			return fmt.Errorf("receiver closed before getting start request")
 		}
+		log.Debug("%%PHEV_START_DONE%%")
 		return nil
+	case <-ctx.Done():
+		log.Debug("%%PHEV_START_TIMEOUT%%")
+		return fmt.Errorf("timed out waiting for start: %w", ctx.Err())
 	}
 }
 
-// SetRegister sets a register on the car.
-func (c *Client) SetRegister(register byte, value []byte) error {
-	setRegister := func(xor byte) {
-		c.Send <- &protocol.PhevMessage{
-			Type:     protocol.CmdOutSend,
-			Ack:      protocol.Request,
-			Register: register,
-			Data:     value,
-			Xor:      xor,
-		}
+// ErrNotConnected is returned when sending to a car that is not connected.
+var ErrNotConnected = errors.New("not connected to car")
+
+var setRegisterTimeout = 10 * time.Second
+
+// SetRegister sets a register on the car. If ctx has no deadline, a
+// default timeout applies.
+func (c *Client) SetRegister(ctx context.Context, register byte, value []byte) error {
+	if c.State() != StateEstablished {
+		return ErrNotConnected
 	}
+	ctx, cancel := withDefaultTimeout(ctx, setRegisterTimeout)
+	defer cancel()
 	xor := byte(0)
-	timer := time.After(10 * time.Second)
 	l := c.AddListener()
 	defer c.RemoveListener(l)
 SETREG:
-	setRegister(xor)
+	select {
+	case c.Send <- &protocol.PhevMessage{
+		Type:     protocol.CmdOutSend,
+		Ack:      protocol.Request,
+		Register: register,
+		Data:     value,
+		Xor:      xor,
+	}:
+	case <-ctx.Done():
+		return c.setRegisterTimeout(ctx, register)
+	}
 	for {
 		select {
-		case <-timer:
-			return fmt.Errorf("timed out attempting to set register %02x", register)
+		case <-ctx.Done():
+			return c.setRegisterTimeout(ctx, register)
 		case msg, ok := <-l.C:
 			if !ok {
 				return fmt.Errorf("listener channel closed")
@@ -219,6 +350,35 @@ SETREG:
 	}
 }
 
+func (c *Client) setRegisterTimeout(ctx context.Context, register byte) error {
+	c.stats.inc(&c.stats.SetRegisterTimeouts)
+	return fmt.Errorf("timed out attempting to set register %02x: %w", register, ctx.Err())
+}
+
+// Returns a context with the timeout applied, if ctx has no deadline.
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// LastRegister returns the last value received for the register,
+// or nil if it has not been received.
+func (c *Client) LastRegister(register byte) protocol.Register {
+	return c.Vehicle.Register(register)
+}
+
+// ApplySetting updates a vehicle setting. See protocol.Settings for
+// the known setting ids. The value is as documented for register
+// 0x0f, e.g 0-4, not as the car reports it in register 0x16.
+func (c *Client) ApplySetting(ctx context.Context, id, value byte) error {
+	if err := c.SetRegister(ctx, protocol.UpdateSettingRegister, []byte{id, value}); err != nil {
+		return err
+	}
+	return c.SetRegister(ctx, protocol.SaveSettingsRegister, []byte{0x0})
+}
+
 func (c *Client) nextRecvMsg(deadline time.Time) (*protocol.PhevMessage, error) {
 	timer := time.After(deadline.Sub(time.Now()))
 	for {
@@ -235,18 +395,30 @@ func (c *Client) nextRecvMsg(deadline time.Time) (*protocol.PhevMessage, error)
 }
 
 // Sends periodic pings to the car.
-func (c *Client) pinger() {
+func (c *Client) pinger(done chan struct{}) {
 	pingSeq := byte(0xa)
 	ticker := time.NewTicker(200 * time.Millisecond)
 	defer ticker.Stop()
-	for t := range ticker.C {
+	for {
+		var t time.Time
+		select {
+		case <-done:
+			return
+		case t = <-ticker.C:
+		}
+		c.sMu.Lock()
+		closed, lastRx := c.closed, c.lastRx
+		c.sMu.Unlock()
 		switch {
-		case c.closed:
+		case closed:
 			return
-		case t.Sub(c.lastRx) < 500*time.Millisecond:
+		case t.Sub(lastRx) < 500*time.Millisecond:
 			continue
 		}
-		c.Send <- protocol.NewPingRequestMessage(pingSeq)
+		if !c.send(done, protocol.NewPingRequestMessage(pingSeq)) {
+			return
+		}
+		c.stats.pingSentAt(pingSeq, time.Now())
 		pingSeq++
 		if pingSeq > 0x63 {
 			pingSeq = 0
@@ -254,68 +426,102 @@ func (c *Client) pinger() {
 	}
 }
 
+// Sends a message on the connection, unless it ends first.
+func (c *Client) send(done chan struct{}, m *protocol.PhevMessage) bool {
+	select {
+	case c.Send <- m:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Signals that the start request was received. The car sends these
+// again during the connection, which nobody waits for.
+func (c *Client) signalStarted(started chan struct{}) {
+	c.setState(StateEstablished, nil)
+	select {
+	case started <- struct{}{}:
+	default:
+	}
+}
+
 // manages the connection, handling control messages.
-func (c *Client) manage() {
+func (c *Client) manage(started, done chan struct{}) {
 	ml := c.AddListener()
-	defer ml.Stop()
-	for m := range ml.C {
+	defer c.RemoveListener(ml)
+	for {
+		var m *protocol.PhevMessage
+		select {
+		case <-done:
+			close(started)
+			log.Debug("%PHEV_MANAGER_END%%")
+			return
+		case m = <-ml.C:
+		}
 		switch m.Type {
 		case protocol.CmdInResp:
 			if m.Ack == protocol.Request && m.Register == protocol.SettingsRegister {
 				c.Settings.FromRegister(m.Data)
 			}
 		case protocol.CmdInStartResp:
-			c.Send <- protocol.NewPingRequestMessage(0xa)
+			c.send(done, protocol.NewPingRequestMessage(0xa))
 		case protocol.CmdInMy24StartReq:
-			c.ModelYear = ModelYear24
-			c.Send <- &protocol.PhevMessage{
+			c.send(done, &protocol.PhevMessage{
 				Type:     protocol.CmdOutMy24StartResp,
 				Register: 0x1,
 				Ack:      protocol.Ack,
 				Xor:      m.Xor,
 				Data:     []byte{0x0},
-			}
+			})
 			log.Debug("%%PHEV_START24_RECV%%")
-			c.started <- struct{}{}
+			c.signalStarted(started)
 		case protocol.CmdInMy18StartReq:
-			c.ModelYear = ModelYear18
-			c.Send <- &protocol.PhevMessage{
+			c.send(done, &protocol.PhevMessage{
 				Type:     protocol.CmdOutMy18StartResp,
 				Register: 0x1,
 				Ack:      protocol.Ack,
 				Xor:      m.Xor,
 				Data:     []byte{0x0},
-			}
+			})
 			log.Debug("%%PHEV_START18_RECV%%")
-			c.started <- struct{}{}
+			c.signalStarted(started)
 		case protocol.CmdInMy14StartReq:
-			c.ModelYear = ModelYear14
-			c.Send <- &protocol.PhevMessage{
+			c.send(done, &protocol.PhevMessage{
 				Type:     protocol.CmdOutMy14StartResp,
 				Register: 0x1,
 				Ack:      protocol.Ack,
 				Xor:      m.Xor,
 				Data:     []byte{0x0},
-			}
+			})
 			log.Debug("%%PHEV_START14_RECV%%")
-			c.started <- struct{}{}
+			c.signalStarted(started)
 		}
 	}
-	close(c.started)
-	log.Debug("%PHEV_MANAGER_END%%")
 }
 
-func (c *Client) reader() {
+func (c *Client) reader(conn net.Conn, key *protocol.SecurityKey, done chan struct{}) {
+	defer close(done)
+	dec := protocol.NewDecoder(conn, key)
+	var skipped int64
 	for {
-		c.conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(30 * time.Second))
-		data := make([]byte, 4096)
-		n, err := c.conn.Read(data)
+		conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(30 * time.Second))
+		m, err := dec.Decode()
+		if n := dec.Skipped(); n > skipped {
+			c.stats.add(&c.stats.SkippedBytes, uint64(n-skipped))
+			skipped = n
+		}
 		if err != nil {
-			if !c.closed {
+			if !c.isClosed() {
 				log.Debug("%%PHEV_TCP_READER_ERROR%%: ", err)
+				c.setState(StateLost, err)
 			}
 			log.Debug("%PHEV_TCP_READER_CLOSE%")
-			c.Close()
+			c.closeConn()
+			if c.supervised {
+				// Recv and listeners remain open for the next connection.
+				return
+			}
 			close(c.Recv)
 			c.lMu.Lock()
 			for _, l := range c.listeners {
@@ -324,24 +530,36 @@ func (c *Client) reader() {
 			c.lMu.Unlock()
 			return
 		}
-		c.lastRx = time.Now()
-		log.Tracef("%%PHEV_TCP_RECV_DATA%%: %s", hex.EncodeToString(data[:n]))
-		messages := protocol.NewFromBytes(data[:n], c.key)
-		for _, m := range messages {
-			log.Debugf("%%PHEV_TCP_RECV_MSG%%: [%02x] %s", m.Xor, m.ShortForm())
-			c.lMu.Lock()
-			for _, l := range c.listeners {
-				l.Send(m)
-			}
-			c.lMu.Unlock()
-			c.Recv <- m
+		now := time.Now()
+		c.sMu.Lock()
+		c.lastRx = now
+		c.sMu.Unlock()
+		log.Debugf("%%PHEV_TCP_RECV_MSG%%: [%02x] %s", m.Xor, m.ShortForm())
+		if m.Err != nil {
+			c.stats.inc(&c.stats.MalformedRegisters)
 		}
+		switch m.Type {
+		case protocol.CmdInBadEncoding:
+			c.stats.inc(&c.stats.BadEncodings)
+		case protocol.CmdInPingResp:
+			c.stats.pingReceivedAt(m.Register, now)
+		}
+		c.setModelYear(m)
+		c.Vehicle.Update(m)
+		c.lMu.Lock()
+		for _, l := range c.listeners {
+			l.Send(m)
+		}
+		c.lMu.Unlock()
+		c.Recv <- m
 	}
 }
 
-func (c *Client) writer() {
+func (c *Client) writer(conn net.Conn, key *protocol.SecurityKey, done chan struct{}) {
 	for {
 		select {
+		case <-done:
+			return
 		case msg, ok := <-c.Send:
 			if !ok {
 				log.Debug("%PHEV_TCP_WRITER_CLOSE%")
@@ -349,16 +567,16 @@ func (c *Client) writer() {
 				return
 			}
 			msg.Xor = 0
-			data := msg.EncodeToBytes(c.key)
+			data := msg.EncodeToBytes(key)
 			log.Debugf("%%PHEV_TCP_SEND_MSG%%: [%02x] %s", msg.Xor, msg.ShortForm())
 			log.Tracef("%%PHEV_TCP_SEND_DATA%%: %s", hex.EncodeToString(data))
-			c.conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(15 * time.Second))
-			if _, err := c.conn.Write(data); err != nil {
-				if !c.closed {
+			conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(15 * time.Second))
+			if _, err := conn.Write(data); err != nil {
+				if !c.isClosed() {
 					log.Errorf("%%PHEV_TCP_WRITER_ERROR%%: %v", err)
 				}
 				log.Debug("%PHEV_TCP_WRITER_CLOSE%")
-				c.Close()
+				c.closeConn()
 				return
 			}
 		}
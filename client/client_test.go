@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// Listens as a car that sends a start request once the client pings,
+// then drops the connection shortly after. Returns its address.
+func startingCar(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					return
+				}
+				key := &protocol.SecurityKey{}
+				start := protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, false, append(key.GenerateProposal(), 0x1))
+				conn.Write(start.EncodeToBytes(&protocol.SecurityKey{}))
+				conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	c, err := New(AddressOption(startingCar(t)), BackoffOption(0, 5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case m := <-c.Recv:
+				if m.Type == protocol.CmdInMy18StartReq && c.ModelYear != ModelYear18 {
+					t.Errorf("ModelYear got=%s want=%s", c.ModelYear, ModelYear18)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Supervise(ctx) }()
+
+	// The car drops each connection, so the client reconnects.
+	end := time.Now().Add(5 * time.Second)
+	for c.Stats().Reconnects < 4 {
+		if time.Now().After(end) {
+			t.Fatalf("Reconnects got=%d want >=4", c.Stats().Reconnects)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Supervise() got=%v want=%v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Supervise() did not return after Close")
+	}
+	if got := c.State(); got != StateDisconnected {
+		t.Errorf("State() got=%s want=%s", got, StateDisconnected)
+	}
+}
+
+func TestBackoffOption(t *testing.T) {
+	for _, test := range []struct {
+		min, max         time.Duration
+		wantMin, wantMax time.Duration
+	}{
+		{time.Second, time.Minute, time.Second, time.Minute},
+		{0, 0, minBackoff, minBackoff},
+		{-time.Second, time.Second, minBackoff, time.Second},
+		{time.Minute, time.Second, time.Minute, time.Minute},
+	} {
+		c, err := New(BackoffOption(test.min, test.max))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.minBackoff != test.wantMin || c.maxBackoff != test.wantMax {
+			t.Errorf("BackoffOption(%v, %v) got=%v,%v want=%v,%v", test.min, test.max, c.minBackoff, c.maxBackoff, test.wantMin, test.wantMax)
+		}
+	}
+}
+
+func TestConnectDropsStaleMessages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan *protocol.PhevMessage, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		m, err := protocol.NewDecoder(conn, &protocol.SecurityKey{}).Decode()
+		if err != nil {
+			t.Errorf("Decode() unexpected error: %v", err)
+			return
+		}
+		got <- m
+	}()
+
+	c, err := New(AddressOption(l.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Left from an earlier connection.
+	for len(c.Send) < cap(c.Send) {
+		c.Send <- &protocol.PhevMessage{Type: protocol.CmdOutSend, Register: 0x99, Data: []byte{0x0}}
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if m.Type != protocol.CmdOutPingReq {
+			t.Errorf("first message got=%s want ping", m.ShortForm())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+	}
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// ClimateMode is the operating mode of the climate control.
+type ClimateMode byte
+
+const (
+	ClimateCool       ClimateMode = 0x1
+	ClimateHeat       ClimateMode = 0x2
+	ClimateWindscreen ClimateMode = 0x3
+)
+
+var climateModeStr = map[ClimateMode]string{
+	ClimateCool:       "cool",
+	ClimateHeat:       "heat",
+	ClimateWindscreen: "windscreen",
+}
+
+func (m ClimateMode) String() string {
+	if s, ok := climateModeStr[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", m)
+}
+
+// ParseClimateMode parses a climate mode name, e.g "heat".
+func ParseClimateMode(s string) (ClimateMode, error) {
+	for m, str := range climateModeStr {
+		if str == strings.ToLower(s) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown climate mode %q", s)
+}
+
+// How long to wait for the car to confirm a command, if the
+// context has no deadline.
+var confirmTimeout = 20 * time.Second
+
+type registerWrite struct {
+	register byte
+	value    []byte
+}
+
+// StartClimate starts the climate control in the given mode for the given
+// duration (10, 20 or 30 minutes). Returns the pre-AC state once the car
+// reports it running.
+func (c *Client) StartClimate(ctx context.Context, mode ClimateMode, duration time.Duration) (*protocol.RegisterPreACState, error) {
+	if _, ok := climateModeStr[mode]; !ok {
+		return nil, fmt.Errorf("unknown climate mode %d", mode)
+	}
+	var dur byte
+	switch duration {
+	case 10 * time.Minute:
+		dur = 0x0
+	case 20 * time.Minute:
+		dur = 0x1
+	case 30 * time.Minute:
+		dur = 0x2
+	default:
+		return nil, fmt.Errorf("invalid climate duration %v", duration)
+	}
+	writes, err := c.climateWrites(byte(mode), dur)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := c.command(ctx, protocol.PreACStateRegister, func(r protocol.Register) bool {
+		s, ok := r.(*protocol.RegisterPreACState)
+		return ok && s.State == protocol.PreACOn
+	}, writes...)
+	if err != nil {
+		return nil, err
+	}
+	return reg.(*protocol.RegisterPreACState), nil
+}
+
+// StopClimate stops the climate control. Returns the pre-AC state once
+// the car reports it stopped.
+func (c *Client) StopClimate(ctx context.Context) (*protocol.RegisterPreACState, error) {
+	writes, err := c.climateWrites(0x0, 0x0)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := c.command(ctx, protocol.PreACStateRegister, func(r protocol.Register) bool {
+		s, ok := r.(*protocol.RegisterPreACState)
+		return ok && s.State != protocol.PreACOn
+	}, writes...)
+	if err != nil {
+		return nil, err
+	}
+	return reg.(*protocol.RegisterPreACState), nil
+}
+
+// Returns the register writes to set the climate state for the
+// model year. A mode of 0x0 turns the climate control off.
+func (c *Client) climateWrites(mode, duration byte) ([]registerWrite, error) {
+	if c.State() != StateEstablished {
+		return nil, ErrNotConnected
+	}
+	switch c.ModelYear {
+	case ModelYear14:
+		// Set the AC mode first, then enable/disable the AC.
+		modePayload := bytes.Repeat([]byte{0xff}, 15)
+		modePayload[0] = 0x0
+		modePayload[1] = 0x0
+		modePayload[6] = mode | duration
+		acEnabled := byte(0x02)
+		if mode == 0x0 {
+			acEnabled = 0x01
+		}
+		return []registerWrite{
+			{protocol.SetACModeRegisterMY14, modePayload},
+			{protocol.SetACEnabledRegisterMY14, []byte{acEnabled}},
+		}, nil
+	case ModelYear18, ModelYear24:
+		state := byte(0x02)
+		if mode == 0x0 {
+			state = 0x1
+		}
+		return []registerWrite{
+			{protocol.SetACModeRegisterMY18, []byte{state, mode, duration, 0x0}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("climate control not supported for unknown model year")
+	}
+}
+
+// SetHeadlights turns the head lights on or off. Returns the door
+// status (which has the head light state) once the car confirms it.
+func (c *Client) SetHeadlights(ctx context.Context, on bool) (*protocol.RegisterDoorStatus, error) {
+	reg, err := c.command(ctx, protocol.DoorStatusRegister, func(r protocol.Register) bool {
+		s, ok := r.(*protocol.RegisterDoorStatus)
+		return ok && s.Headlights == on
+	}, registerWrite{protocol.SetHeadlightsRegister, []byte{lightValue(on)}})
+	if err != nil {
+		return nil, err
+	}
+	return reg.(*protocol.RegisterDoorStatus), nil
+}
+
+// SetParkingLights turns the parking lights on or off. Returns the
+// battery level (which has the parking light state) once the car
+// confirms it.
+func (c *Client) SetParkingLights(ctx context.Context, on bool) (*protocol.RegisterBatteryLevel, error) {
+	reg, err := c.command(ctx, protocol.BatteryLevelRegister, func(r protocol.Register) bool {
+		s, ok := r.(*protocol.RegisterBatteryLevel)
+		return ok && s.ParkingLights == on
+	}, registerWrite{protocol.SetParkingLightsRegister, []byte{lightValue(on)}})
+	if err != nil {
+		return nil, err
+	}
+	return reg.(*protocol.RegisterBatteryLevel), nil
+}
+
+func lightValue(on bool) byte {
+	if on {
+		return 0x1
+	}
+	return 0x2
+}
+
+// CancelChargeTimer cancels the charge timer, so charging starts
+// immediately. There is no known register confirming this, so it
+// only waits for the car to ack the writes.
+func (c *Client) CancelChargeTimer(ctx context.Context) error {
+	if err := c.SetRegister(ctx, protocol.CancelChargeTimerRegister, []byte{0x1}); err != nil {
+		return err
+	}
+	return c.SetRegister(ctx, protocol.CancelChargeTimerRegister, []byte{0x11})
+}
+
+// AcknowledgePreACTermination clears the "terminated" pre-AC state,
+// set when the climate control was stopped by e.g a door opening.
+// Returns the pre-AC state once the car confirms it.
+func (c *Client) AcknowledgePreACTermination(ctx context.Context) (*protocol.RegisterPreACState, error) {
+	reg, err := c.command(ctx, protocol.PreACStateRegister, func(r protocol.Register) bool {
+		s, ok := r.(*protocol.RegisterPreACState)
+		return ok && s.State != protocol.PreACTerminated
+	}, registerWrite{protocol.SetAckPreACTermRegister, []byte{0x1}})
+	if err != nil {
+		return nil, err
+	}
+	return reg.(*protocol.RegisterPreACState), nil
+}
+
+// command sets the registers in order, then waits until the confirm
+// register is received with a value for which confirm returns true.
+// If the car already had the confirmed value it may not send it again,
+// so the last received value is also checked once the writes are acked.
+func (c *Client) command(ctx context.Context, confirmReg byte, confirm func(protocol.Register) bool, writes ...registerWrite) (protocol.Register, error) {
+	ctx, cancel := withDefaultTimeout(ctx, confirmTimeout)
+	defer cancel()
+	l := c.AddListener()
+	defer c.RemoveListener(l)
+
+	// Write in the background, so no updates are missed while waiting for acks.
+	errCh := make(chan error, 1)
+	go func() {
+		for _, w := range writes {
+			if err := c.SetRegister(ctx, w.register, w.value); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	var confirmed protocol.Register
+	written := false
+	for !written || confirmed == nil {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for register %02x to confirm command: %w", confirmReg, ctx.Err())
+		case err := <-errCh:
+			if err != nil {
+				return nil, err
+			}
+			written = true
+			if reg := c.LastRegister(confirmReg); confirmed == nil && reg != nil && confirm(reg) {
+				confirmed = reg
+			}
+		case msg, ok := <-l.C:
+			if !ok {
+				return nil, fmt.Errorf("listener channel closed")
+			}
+			if msg.Type == protocol.CmdInResp && msg.Ack == protocol.Request && msg.Register == confirmReg && msg.Reg != nil && confirm(msg.Reg) {
+				confirmed = msg.Reg
+			}
+		}
+	}
+	return confirmed, nil
+}
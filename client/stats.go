@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats are counters of the health of the connection to the car.
+type Stats struct {
+	// Reconnects is the number of reconnection attempts when supervised.
+	Reconnects uint64
+	// BadEncodings is the number of bad encoding messages from the car.
+	BadEncodings uint64
+	// SetRegisterTimeouts is the number of register writes not acked in time.
+	SetRegisterTimeouts uint64
+	// SkippedBytes is the number of bytes from the car that were not
+	// part of a valid message.
+	SkippedBytes uint64
+	// MalformedRegisters is the number of registers from the car that
+	// could not be decoded.
+	MalformedRegisters uint64
+	// PingRTT is the round trip time of the last answered ping.
+	PingRTT time.Duration
+}
+
+type stats struct {
+	mu sync.Mutex
+	Stats
+	// The last ping sent, for the round trip time.
+	pingSeq  byte
+	pingSent time.Time
+}
+
+// Stats returns the connection health counters.
+func (c *Client) Stats() Stats {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	return c.stats.Stats
+}
+
+func (s *stats) inc(counter *uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter++
+}
+
+func (s *stats) add(counter *uint64, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter += n
+}
+
+func (s *stats) pingSentAt(seq byte, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pingSeq = seq
+	s.pingSent = t
+}
+
+// Records the round trip time, if the response is for the last ping sent.
+func (s *stats) pingReceivedAt(seq byte, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq != s.pingSeq || s.pingSent.IsZero() {
+		return
+	}
+	s.PingRTT = t.Sub(s.pingSent)
+	s.pingSent = time.Time{}
+}
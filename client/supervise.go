@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnectionState is the state of the connection to the car.
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateSecuring
+	StateEstablished
+	StateLost
+)
+
+var connectionStateStr = map[ConnectionState]string{
+	StateDisconnected: "disconnected",
+	StateConnecting:   "connecting",
+	StateSecuring:     "securing",
+	StateEstablished:  "established",
+	StateLost:         "lost",
+}
+
+func (s ConnectionState) String() string {
+	if str, ok := connectionStateStr[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("unknown(%d)", s)
+}
+
+// A ConnectionEvent is sent on a change of connection state.
+type ConnectionEvent struct {
+	State ConnectionState
+	Time  time.Time
+	// Err is the reason for a connection failing, if known.
+	Err error
+}
+
+// State returns the current connection state.
+func (c *Client) State() ConnectionState {
+	c.sMu.Lock()
+	defer c.sMu.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(s ConnectionState, err error) {
+	c.sMu.Lock()
+	if c.state == s {
+		c.sMu.Unlock()
+		return
+	}
+	c.state = s
+	c.sMu.Unlock()
+	log.Debugf("%%PHEV_CONNECTION_STATE%%: %s", s)
+	select {
+	case c.Events <- ConnectionEvent{State: s, Time: time.Now(), Err: err}:
+	default:
+	}
+}
+
+// Supervise connects to the car and keeps it connected until ctx is
+// cancelled or the client is closed, reconnecting with exponential
+// backoff. Unlike a plain Connect, Recv and listeners stay open
+// across reconnections.
+func (c *Client) Supervise(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.sMu.Lock()
+	c.cancel = cancel
+	c.sMu.Unlock()
+	c.supervised = true
+	backoff := c.minBackoff
+	for {
+		err := c.Connect(ctx)
+		if err == nil {
+			c.sMu.Lock()
+			done := c.done
+			c.sMu.Unlock()
+			if err = c.Start(ctx); err == nil {
+				backoff = c.minBackoff
+				select {
+				case <-done:
+					err = fmt.Errorf("connection lost")
+				case <-ctx.Done():
+				}
+			}
+			c.closeConn()
+			<-done
+			c.setState(StateLost, err)
+		}
+		if ctx.Err() != nil {
+			c.setState(StateDisconnected, nil)
+			return ctx.Err()
+		}
+		// Jitter the delay so many clients don't retry in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Infof("%%PHEV_RECONNECT%%: retrying in %v: %v", wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			c.setState(StateDisconnected, nil)
+			return ctx.Err()
+		}
+		c.stats.inc(&c.stats.Reconnects)
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
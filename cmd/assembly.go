@@ -0,0 +1,208 @@
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/session"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// The car listens on this port.
+var phevPort = layers.NewTCPPortEndpoint(8080)
+
+// A phevFlow is a TCP connection between a client and the car.
+type phevFlow struct {
+	id     int
+	client string
+	// The security key of each direction.
+	keys map[string]*protocol.SecurityKey
+	// Directions not yet closed.
+	open int
+}
+
+// phevAssembly decodes the reassembled TCP streams to and from the car,
+// as a tcpassembly.StreamFactory. Streams are called from the
+// assembler, so need no locking.
+type phevAssembly struct {
+	cmd   *cobra.Command
+	flows map[string]*phevFlow
+	// Numbers the flows.
+	count int
+	// Records the streams, if set.
+	recorder *session.Writer
+}
+
+func newPhevAssembly(cmd *cobra.Command) *phevAssembly {
+	return &phevAssembly{cmd: cmd, flows: map[string]*phevFlow{}}
+}
+
+// New returns the stream for one direction of a connection.
+func (a *phevAssembly) New(net, transport gopacket.Flow) tcpassembly.Stream {
+	dir := session.Out
+	client := fmt.Sprintf("%s:%s", net.Src(), transport.Src())
+	if transport.Src() == phevPort {
+		dir = session.In
+		client = fmt.Sprintf("%s:%s", net.Dst(), transport.Dst())
+	}
+	f, ok := a.flows[client]
+	if !ok {
+		a.count++
+		f = &phevFlow{
+			id:     a.count,
+			client: client,
+			keys: map[string]*protocol.SecurityKey{
+				session.In:  {},
+				session.Out: {},
+			},
+		}
+		a.flows[client] = f
+		log.Infof("%%PHEV_FLOW_START%% [%d] Connection from %s", f.id, client)
+	}
+	f.open++
+	return &phevStream{assembly: a, flow: f, dir: dir}
+}
+
+// A phevStream is one direction of a connection.
+type phevStream struct {
+	assembly *phevAssembly
+	flow     *phevFlow
+	dir      string
+	// Data not yet decoded, such as the start of a split message.
+	buf []byte
+}
+
+// Reassembled decodes the data in order, without retransmits.
+func (s *phevStream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, r := range reassemblies {
+		if r.Skip != 0 {
+			log.Infof("%%PHEV_FLOW_SKIP%% [%d] %s missing data, skipped %d bytes", s.flow.id, s.dir, r.Skip)
+			s.buf = nil
+		}
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		s.record(r.Seen, r.Bytes)
+		s.buf = append(s.buf, r.Bytes...)
+		s.decode(r.Seen)
+	}
+}
+
+func (s *phevStream) record(t time.Time, data []byte) {
+	if s.assembly.recorder == nil {
+		return
+	}
+	if err := s.assembly.recorder.Write(session.NewRecord(t, s.flow.id, s.dir, data)); err != nil {
+		log.Errorf("Error recording: %v", err)
+	}
+}
+
+// ReassemblyComplete closes the stream, and the flow once both
+// directions close.
+func (s *phevStream) ReassemblyComplete() {
+	if len(s.buf) > 0 {
+		log.Debugf("%%PHEV_FLOW_SKIP%% [%d] %s %d bytes left over", s.flow.id, s.dir, len(s.buf))
+	}
+	s.flow.open--
+	if s.flow.open > 0 {
+		return
+	}
+	log.Infof("%%PHEV_FLOW_END%% [%d] Connection from %s closed", s.flow.id, s.flow.client)
+	if s.assembly.flows[s.flow.client] == s.flow {
+		delete(s.assembly.flows, s.flow.client)
+	}
+}
+
+// Decodes the complete messages in the buffer.
+func (s *phevStream) decode(t time.Time) {
+	for {
+		start, end, ok := protocol.FindMessage(s.buf)
+		if start > 0 {
+			log.Debugf("%%PHEV_FLOW_SKIP%% [%d] %s skipped %d bytes", s.flow.id, s.dir, start)
+		}
+		if !ok {
+			// Keep any partial message for the next data.
+			s.buf = s.buf[start:]
+			return
+		}
+		s.decodeMessage(t, s.buf[start:end])
+		s.buf = s.buf[end:]
+	}
+}
+
+func (s *phevStream) decodeMessage(t time.Time, data []byte) {
+	key := s.flow.keys[s.dir]
+	for _, msg := range protocol.NewFromBytes(data, key) {
+		switch msg.Type {
+		case protocol.CmdInMy14StartReq, protocol.CmdInMy18StartReq, protocol.CmdInMy24StartReq:
+			// The car's start request sets the key both ways.
+			s.flow.keys[session.Out] = key.Copy()
+		}
+		printMessage(s.assembly.cmd, s.flow.id, s.dir, t, msg)
+	}
+}
+
+// Outputs a decoded message, filtered by the direction and pings flags,
+// or only register changes with the registers flag.
+func printMessage(cmd *cobra.Command, conn int, dir string, t time.Time, msg *protocol.PhevMessage) {
+	if d, _ := cmd.Flags().GetString("direction"); d != "both" && d != dir {
+		return
+	}
+	if r, _ := cmd.Flags().GetBool("registers"); r {
+		handleRegisters(msg)
+		return
+	}
+	if pings, _ := cmd.Flags().GetBool("pings"); !pings && (msg.Type == protocol.CmdOutPingReq || msg.Type == protocol.CmdInPingResp) {
+		return
+	}
+	if jsonOutput(cmd) {
+		if err := printJSON(t, conn, dir, msg); err != nil {
+			log.Errorf("Error writing JSON: %v", err)
+		}
+		return
+	}
+	if dir == session.In {
+		dir = "in "
+	}
+	log.Infof("[%d] %s [%02x] %s", conn, dir, msg.Xor, msg.ShortForm())
+}
+
+var regs = map[byte]string{}
+
+func handleRegisters(m *protocol.PhevMessage) {
+	if m.Type == protocol.CmdInResp {
+		data := hex.EncodeToString(m.Data)
+		if d := regs[m.Register]; d != data {
+			if m.Err != nil {
+				log.Infof("UPDATEREG 0x%02x: %s -> %s (malformed: %v)\n", m.Register, d, data, m.Err)
+			} else if m.Reg != nil {
+				log.Infof("UPDATEREG 0x%02x: %s -> %s (%s)\n", m.Register, d, data, m.Reg.String())
+			} else {
+				log.Infof("UPDATEREG 0x%02x: %s -> %s\n", m.Register, d, data)
+			}
+			regs[m.Register] = data
+		}
+	}
+}
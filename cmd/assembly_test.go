@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/cobra"
+)
+
+var carIP = net.IPv4(192, 168, 8, 46)
+
+// A segment is TCP data between a client port and the car.
+type segment struct {
+	port  int
+	toCar bool
+	seq   uint32
+	syn   bool
+	data  []byte
+}
+
+// Returns the segment as a decoded packet.
+func (s segment) packet(t *testing.T) gopacket.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(192, 168, 8, 100), DstIP: carIP}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(s.port), DstPort: 8080, Seq: s.seq, SYN: s.syn, ACK: !s.syn, Window: 1024}
+	if !s.toCar {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(s.data)); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// Feeds the segments through the assembler, and returns the messages
+// printed.
+func assemble(t *testing.T, segments []segment) []string {
+	t.Helper()
+	cmd := &cobra.Command{}
+	cmd.Flags().String("direction", "both", "")
+	cmd.Flags().Bool("registers", false, "")
+	cmd.Flags().Bool("pings", true, "")
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(newPhevAssembly(cmd)))
+	now := time.Now()
+	for _, s := range segments {
+		p := s.packet(t)
+		assembler.AssembleWithTimestamp(p.NetworkLayer().NetworkFlow(), p.TransportLayer().(*layers.TCP), now)
+	}
+	assembler.FlushAll()
+
+	got := []string{}
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "[") {
+			got = append(got, e.Message)
+		}
+	}
+	return got
+}
+
+func ping(id byte) []byte {
+	return protocol.NewMessage(protocol.CmdOutPingReq, id, false, []byte{0x0}).EncodeToBytes(&protocol.SecurityKey{})
+}
+
+func pingResp(id byte) []byte {
+	return protocol.NewMessage(protocol.CmdInPingResp, id, false, []byte{0x0}).EncodeToBytes(&protocol.SecurityKey{})
+}
+
+func pingLine(conn int, id byte) string {
+	return fmt.Sprintf("[%d] out [00] PING REQ      (id %x)", conn, id)
+}
+
+func pingRespLine(conn int, id byte) string {
+	return fmt.Sprintf("[%d] in  [00] PING RESP     (id %x)", conn, id)
+}
+
+func TestPhevAssembly(t *testing.T) {
+	p1, p2, p3 := ping(1), ping(2), ping(3)
+	n := uint32(len(p1))
+	for _, test := range []struct {
+		name     string
+		segments []segment
+		want     []string
+	}{
+		{
+			name: "in order",
+			segments: []segment{
+				{port: 5000, toCar: true, seq: 99, syn: true},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+				{port: 5000, toCar: true, seq: 100 + n, data: p2},
+			},
+			want: []string{pingLine(1, 1), pingLine(1, 2)},
+		},
+		{
+			name: "out of order",
+			segments: []segment{
+				{port: 5000, toCar: true, seq: 99, syn: true},
+				{port: 5000, toCar: true, seq: 100 + 2*n, data: p3},
+				{port: 5000, toCar: true, seq: 100 + n, data: p2},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+			},
+			want: []string{pingLine(1, 1), pingLine(1, 2), pingLine(1, 3)},
+		},
+		{
+			name: "duplicate",
+			segments: []segment{
+				{port: 5000, toCar: true, seq: 99, syn: true},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+				{port: 5000, toCar: true, seq: 100 + n, data: p2},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+			},
+			want: []string{pingLine(1, 1), pingLine(1, 2)},
+		},
+		{
+			name: "split message",
+			segments: []segment{
+				{port: 5000, toCar: true, seq: 99, syn: true},
+				{port: 5000, toCar: true, seq: 100, data: append(append([]byte{}, p1...), p2[:2]...)},
+				{port: 5000, toCar: true, seq: 100 + n + 2, data: p2[2:]},
+			},
+			want: []string{pingLine(1, 1), pingLine(1, 2)},
+		},
+		{
+			name: "connections",
+			segments: []segment{
+				{port: 5000, toCar: true, seq: 99, syn: true},
+				{port: 5000, toCar: false, seq: 499, syn: true},
+				{port: 5001, toCar: true, seq: 199, syn: true},
+				{port: 5001, toCar: false, seq: 599, syn: true},
+				{port: 5000, toCar: true, seq: 100, data: p1},
+				{port: 5001, toCar: true, seq: 200, data: p2},
+				{port: 5001, toCar: false, seq: 600, data: pingResp(2)},
+				{port: 5000, toCar: false, seq: 500, data: pingResp(1)},
+			},
+			want: []string{pingLine(1, 1), pingLine(2, 2), pingRespLine(2, 2), pingRespLine(1, 1)},
+		},
+	} {
+		got := assemble(t, test.segments)
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
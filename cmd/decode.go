@@ -17,6 +17,12 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
 	"github.com/spf13/cobra"
 )
 
@@ -27,7 +33,23 @@ var decodeCmd = &cobra.Command{
 	Long: `
 Commands for decoding messages to and from a Phev.
 Subcommands provide specific functionality, see below.
+
+With --output json, each message is written to stdout as a JSON
+object per line, with its capture time, connection and direction if known.
 `,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Cobra only runs the closest pre-run, so set up logging too.
+		rootCmd.PersistentPreRun(cmd, args)
+		if strict, _ := cmd.Flags().GetBool("strict"); strict {
+			protocol.SetStrict(true)
+		}
+		switch output, _ := cmd.Flags().GetString("output"); output {
+		case "text", "json":
+			return nil
+		default:
+			return fmt.Errorf("unknown output format %q, want text or json", output)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
@@ -41,8 +63,43 @@ func init() {
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
 	// decodeCmd.PersistentFlags().String("foo", "", "A help for foo")
+	decodeCmd.PersistentFlags().StringP("output", "o", "text", "Output format, text or json")
+	decodeCmd.PersistentFlags().Bool("strict", false, "Treat registers of unknown length as malformed")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// decodeCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+// Returns true if messages should be output as JSON.
+func jsonOutput(cmd *cobra.Command) bool {
+	output, _ := cmd.Flags().GetString("output")
+	return output == "json"
+}
+
+// Writes the message to stdout as a line of JSON, with its capture
+// time, connection number and direction if known.
+func printJSON(t time.Time, conn int, dir string, msg *protocol.PhevMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	meta := struct {
+		Time      *time.Time `json:"time,omitempty"`
+		Conn      int        `json:"conn,omitempty"`
+		Direction string     `json:"direction,omitempty"`
+	}{Conn: conn, Direction: dir}
+	if !t.IsZero() {
+		meta.Time = &t
+	}
+	prefix, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if len(prefix) > 2 {
+		// Splice the time and direction into the message object.
+		data = append(append(prefix[:len(prefix)-1], ','), data[1:]...)
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+	return err
+}
@@ -17,8 +17,10 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"github.com/buxtronix/phev2mqtt/client"
 	"github.com/buxtronix/phev2mqtt/emulator"
 	"github.com/spf13/cobra"
 	"strings"
@@ -36,6 +38,17 @@ var emulatorCmd = &cobra.Command{
 If --mqtt_server is specified, it will connect to the given
 MQTT server, and allow you to send registers to the client,
 at topic phev/emu/set/register/<reg>
+
+Registration mode can be turned on or off at topic
+phev/emu/set/registration_mode, with payload on or off.
+
+If --scenario is specified, it runs the scenario file once the
+emulator starts. See emulator.Scenario for the file format.
+
+If --replay is specified, the emulator takes the registers, settings
+and model year of the car in a session recorded by "proxy --record"
+or "decode pcap --record", and replays the car's register changes
+with their original timing.
 	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		emu := &emu{}
@@ -120,13 +133,51 @@ func (e *emu) handleIncomingMqtt(client mqtt.Client, msg mqtt.Message) {
 			log.Infof("Error setting register %02x: %v", register[0], err)
 			return
 		}
+	case msg.Topic() == e.topic("/set/registration_mode"):
+		on := strings.ToLower(string(msg.Payload())) == "on"
+		log.Infof("Registration mode on=%v", on)
+		e.car.SetRegistrationMode(on)
 	}
 }
 
 func (e *emu) manageCar(cmd *cobra.Command) error {
-	var err error
 	address, _ := cmd.Flags().GetString("address")
-	e.car, err = emulator.NewCar(emulator.AddressOption(address))
+	year, _ := cmd.Flags().GetString("model_year")
+	modelYear, err := client.ParseModelYear(year)
+	if err != nil {
+		return err
+	}
+	var scenario *emulator.Scenario
+	if path, _ := cmd.Flags().GetString("scenario"); path != "" {
+		if scenario, err = emulator.LoadScenario(path); err != nil {
+			return err
+		}
+	}
+	var replay *emulator.Replay
+	if path, _ := cmd.Flags().GetString("replay"); path != "" {
+		if replay, err = emulator.LoadReplay(path); err != nil {
+			return err
+		}
+	}
+	registered, _ := cmd.Flags().GetStringSlice("registered")
+	enforce, _ := cmd.Flags().GetBool("enforce_registration")
+	registrationMode, _ := cmd.Flags().GetBool("registration_mode")
+	opts := []emulator.Option{
+		emulator.AddressOption(address),
+		emulator.ModelYearOption(modelYear),
+		emulator.FaultsOption(faults(cmd)),
+		emulator.RegisteredClientsOption(registered...),
+		emulator.EnforceRegistrationOption(enforce),
+		emulator.RegistrationModeOption(registrationMode),
+	}
+	if replay != nil {
+		opts = append(opts, emulator.ReplayOption(replay))
+		// An explicit model year overrides the recorded one.
+		if cmd.Flags().Changed("model_year") {
+			opts = append(opts, emulator.ModelYearOption(modelYear))
+		}
+	}
+	e.car, err = emulator.NewCar(opts...)
 	if err != nil {
 		return err
 	}
@@ -134,9 +185,36 @@ func (e *emu) manageCar(cmd *cobra.Command) error {
 		return err
 	}
 	e.publish("/available", "online")
+	if scenario != nil {
+		go func() {
+			if err := e.car.RunScenario(context.Background(), scenario); err != nil {
+				log.Errorf("Error running scenario: %v", err)
+			}
+		}()
+	}
+	if replay != nil {
+		go func() {
+			if err := e.car.RunReplay(context.Background(), replay); err != nil {
+				log.Errorf("Error running replay: %v", err)
+			}
+		}()
+	}
 	select {}
 }
 
+// Returns the faults to inject from the flags.
+func faults(cmd *cobra.Command) emulator.Faults {
+	f := emulator.Faults{}
+	f.Drop, _ = cmd.Flags().GetFloat64("fault_drop")
+	f.AckDelay, _ = cmd.Flags().GetDuration("fault_ack_delay")
+	f.BadEncoding, _ = cmd.Flags().GetFloat64("fault_bad_encoding")
+	f.Rekey, _ = cmd.Flags().GetFloat64("fault_rekey")
+	f.Split, _ = cmd.Flags().GetFloat64("fault_split")
+	f.Coalesce, _ = cmd.Flags().GetFloat64("fault_coalesce")
+	f.Disconnect, _ = cmd.Flags().GetFloat64("fault_disconnect")
+	return f
+}
+
 func init() {
 	rootCmd.AddCommand(emulatorCmd)
 
@@ -153,4 +231,17 @@ func init() {
 	emulatorCmd.Flags().String("mqtt_username", "", "Username to login to MQTT server")
 	emulatorCmd.Flags().String("mqtt_password", "", "Password to login to MQTT server")
 	emulatorCmd.Flags().String("mqtt_topic_prefix", "phev/emu", "Prefix for MQTT topics")
+	emulatorCmd.Flags().String("model_year", "MY18", "Model year of car to emulate, MY14, MY18 or MY24")
+	emulatorCmd.Flags().String("scenario", "", "YAML or JSON scenario file to run")
+	emulatorCmd.Flags().String("replay", "", "Recorded session of a car to replay")
+	emulatorCmd.Flags().StringSlice("registered", nil, "IP addresses of clients already registered with the car")
+	emulatorCmd.Flags().Bool("enforce_registration", false, "Reject connections from unregistered clients, unless in registration mode")
+	emulatorCmd.Flags().Bool("registration_mode", false, "Start the car in registration mode, so clients can register")
+	emulatorCmd.Flags().Float64("fault_drop", 0, "Probability of dropping each message to the client")
+	emulatorCmd.Flags().Duration("fault_ack_delay", 0, "Maximum random delay before acking register writes")
+	emulatorCmd.Flags().Float64("fault_bad_encoding", 0, "Probability of a bad encoding response to each client message")
+	emulatorCmd.Flags().Float64("fault_rekey", 0, "Probability of rekeying on each ping")
+	emulatorCmd.Flags().Float64("fault_split", 0, "Probability of splitting each message across TCP segments")
+	emulatorCmd.Flags().Float64("fault_coalesce", 0, "Probability of sending queued messages in one TCP segment")
+	emulatorCmd.Flags().Float64("fault_disconnect", 0, "Probability of disconnecting after each message")
 }
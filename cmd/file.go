@@ -20,6 +20,7 @@ import (
 	"encoding/hex"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/buxtronix/phev2mqtt/protocol"
 	log "github.com/sirupsen/logrus"
@@ -56,6 +57,12 @@ Decode raw hex string messages from the provided filename.
 		securityKey = &protocol.SecurityKey{}
 		for _, msg := range protocol.NewFromBytes(binData, securityKey) {
 			log.Debug(hex.EncodeToString(msg.Original))
+			if jsonOutput(cmd) {
+				if err := printJSON(time.Time{}, 0, "", msg); err != nil {
+					log.Errorf("Error writing JSON: %v", err)
+				}
+				continue
+			}
 			log.Infof("%s", msg.ShortForm())
 		}
 	},
@@ -21,6 +21,7 @@ import (
 	"github.com/buxtronix/phev2mqtt/protocol"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"time"
 )
 
 // hexCmd represents the hex command
@@ -40,6 +41,12 @@ should be in hex format, e;g 'dc2b2f762f7f'.`,
 			}
 			for _, msg := range protocol.NewFromBytes(data, securityKey) {
 				log.Debug(hex.EncodeToString(msg.Original))
+				if jsonOutput(cmd) {
+					if err := printJSON(time.Time{}, 0, "", msg); err != nil {
+						log.Errorf("Error writing JSON: %v", err)
+					}
+					continue
+				}
 				log.Infof("%s", msg.ShortForm())
 			}
 		}
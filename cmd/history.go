@@ -0,0 +1,229 @@
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/history"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// historyCmd represents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Query the history of vehicle state",
+	Long: `Queries the history recorded by the mqtt and http client
+commands, when run with --history_db.
+
+Times are given as e.g "2021-06-30" or "2021-06-30 18:00", in local time.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var historyBatteryCmd = &cobra.Command{
+	Use:          "battery",
+	Short:        "Show battery levels over time",
+	SilenceUsage: true,
+	RunE:         runHistoryBattery,
+}
+
+var historyChargeCmd = &cobra.Command{
+	Use:          "charge",
+	Short:        "Show charge sessions, with the estimated energy charged",
+	SilenceUsage: true,
+	RunE:         runHistoryCharge,
+}
+
+var historyTripsCmd = &cobra.Command{
+	Use:          "trips",
+	Short:        "Show trips, from the ignition and battery level",
+	SilenceUsage: true,
+	RunE:         runHistoryTrips,
+}
+
+// Adds the flags of the commands that record or query history.
+func addHistoryFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("history_db", "", "Database file to record vehicle history in")
+	cmd.PersistentFlags().Float64("battery_capacity", 12, "Usable battery capacity in kWh, to estimate energy charged")
+}
+
+// Binds the history flags of the command being run, as several
+// commands have them.
+func bindHistoryFlags(cmd *cobra.Command) {
+	viper.BindPFlag("history_db", cmd.Flags().Lookup("history_db"))
+	viper.BindPFlag("battery_capacity", cmd.Flags().Lookup("battery_capacity"))
+}
+
+// Opens the history database, or returns nil if none is configured.
+func openHistory(cmd *cobra.Command) (*history.Store, error) {
+	bindHistoryFlags(cmd)
+	path := viper.GetString("history_db")
+	if path == "" {
+		return nil, nil
+	}
+	return history.Open(path)
+}
+
+// Restores the last known state from history into v, returning the
+// restored registers in time order.
+func restoreHistory(store *history.Store, v *vehicle.Vehicle) ([]history.Entry, error) {
+	latest, err := store.Latest()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].Time.Before(latest[j].Time) })
+	for _, e := range latest {
+		v.UpdateAt(protocol.NewRegisterMessage(e.Register, e.ModelYear, e.Data), e.Time)
+	}
+	log.Infof("Restored %d registers from history", len(latest))
+	return latest, nil
+}
+
+// Records a register update from the car in the history, with the
+// model year it is decoded as.
+func recordHistory(store *history.Store, year protocol.ModelYear, msg *protocol.PhevMessage) {
+	if store == nil || msg.Type != protocol.CmdInResp || msg.Ack != protocol.Request {
+		return
+	}
+	if err := store.SetModelYear(year); err != nil {
+		log.Errorf("Error recording model year: %v", err)
+	}
+	if _, err := store.Record(time.Now(), msg.Register, msg.Data); err != nil {
+		log.Errorf("Error recording history: %v", err)
+	}
+}
+
+var historyTimeFormats = []string{"2006-01-02 15:04", "2006-01-02"}
+
+// Returns the query time range from the flags.
+func historyRange(cmd *cobra.Command) (time.Time, time.Time, error) {
+	parse := func(flag string, def time.Time) (time.Time, error) {
+		s, _ := cmd.Flags().GetString(flag)
+		if s == "" {
+			return def, nil
+		}
+		for _, f := range historyTimeFormats {
+			if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("bad --%s time %q", flag, s)
+	}
+	to, err := parse("to", time.Now())
+	if err != nil {
+		return to, to, err
+	}
+	from, err := parse("from", to.Add(-24*time.Hour))
+	return from, to, err
+}
+
+func queryHistory(cmd *cobra.Command, registers ...byte) ([]history.Entry, error) {
+	from, to, err := historyRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	bindHistoryFlags(cmd)
+	path := viper.GetString("history_db")
+	if path == "" {
+		return nil, fmt.Errorf("no --history_db given")
+	}
+	store, err := history.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.Query(from, to, registers...)
+}
+
+// Formats the time for a history report, "-" if not known.
+func historyTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(historyTimeFormats[0])
+}
+
+func runHistoryBattery(cmd *cobra.Command, args []string) error {
+	entries, err := queryHistory(cmd, protocol.BatteryLevelRegister)
+	if err != nil {
+		return err
+	}
+	for _, l := range history.BatteryLevels(entries) {
+		fmt.Printf("%s  %3d%%\n", historyTime(l.Time), l.Level)
+	}
+	return nil
+}
+
+func runHistoryCharge(cmd *cobra.Command, args []string) error {
+	entries, err := queryHistory(cmd, protocol.BatteryLevelRegister, protocol.ChargeStatusRegister, protocol.ChargePlugRegister)
+	if err != nil {
+		return err
+	}
+	var total float64
+	var totalTime time.Duration
+	sessions := history.ChargeSessions(entries, viper.GetFloat64("battery_capacity"))
+	fmt.Printf("%-16s  %-16s  %-16s  %-16s  %8s  %11s  %6s\n", "Plugged in", "Charge start", "Charge end", "Unplugged", "Charging", "Level", "kWh")
+	for _, s := range sessions {
+		fmt.Printf("%-16s  %-16s  %-16s  %-16s  %8v  %3d%% -> %3d%%  %6.2f\n",
+			historyTime(s.PluggedIn), historyTime(s.Start), historyTime(s.End), historyTime(s.Unplugged),
+			s.Duration().Round(time.Minute), s.StartLevel, s.EndLevel, s.Energy)
+		total += s.Energy
+		totalTime += s.Duration()
+	}
+	fmt.Printf("%d sessions, %v charging, %.2f kWh\n", len(sessions), totalTime.Round(time.Minute), total)
+	return nil
+}
+
+func runHistoryTrips(cmd *cobra.Command, args []string) error {
+	entries, err := queryHistory(cmd, protocol.BatteryLevelRegister, protocol.ChargeStatusRegister, protocol.DoorStatusRegister, protocol.ACOperStatusRegister, protocol.PreACStateRegister)
+	if err != nil {
+		return err
+	}
+	var totalTime time.Duration
+	trips := history.Trips(entries)
+	fmt.Printf("%-16s  %-16s  %8s  %11s\n", "Start", "End", "Duration", "Level")
+	for _, t := range trips {
+		inferred := ""
+		if t.Inferred {
+			inferred = "  (inferred)"
+		}
+		fmt.Printf("%-16s  %-16s  %8v  %3d%% -> %3d%%%s\n",
+			historyTime(t.Start), historyTime(t.End), t.Duration().Round(time.Minute), t.StartLevel, t.EndLevel, inferred)
+		totalTime += t.Duration()
+	}
+	fmt.Printf("%d trips, %v driving\n", len(trips), totalTime.Round(time.Minute))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.AddCommand(historyBatteryCmd)
+	historyCmd.AddCommand(historyChargeCmd)
+	historyCmd.AddCommand(historyTripsCmd)
+
+	addHistoryFlags(historyCmd)
+	historyCmd.PersistentFlags().String("from", "", "Start of the time range (default 24h before --to)")
+	historyCmd.PersistentFlags().String("to", "", "End of the time range (default now)")
+}
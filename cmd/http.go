@@ -0,0 +1,118 @@
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/history"
+	"github.com/buxtronix/phev2mqtt/httpapi"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// httpCmd represents the http command
+var httpCmd = &cobra.Command{
+	Use:   "http",
+	Short: "Start an HTTP API server.",
+	Long: `Maintains a connection to the Phev (retry as needed) and serves a
+JSON HTTP API to read its state and send it commands.
+
+GET /state, /connection, /registers and /registers/<xx> return the
+vehicle state, connection status and raw registers.
+
+POST /climate, /lights/head, /lights/parking, /charge/timer/cancel
+and /registers/<xx> send commands to the car.
+
+GET /events streams messages from the car as server-sent events.
+
+GET /metrics has vehicle and connection metrics for Prometheus.
+
+See the phev2mqtt Github page for more details.
+`,
+	SilenceUsage: true,
+	RunE:         runHTTP,
+}
+
+func runHTTP(cmd *cobra.Command, args []string) error {
+	address := viper.GetString("address")
+	listen := viper.GetString("http_listen")
+
+	cl, err := client.New(client.AddressOption(address))
+	if err != nil {
+		return err
+	}
+
+	store, err := openHistory(cmd)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+		if _, err := restoreHistory(store, cl.Vehicle); err != nil {
+			log.Errorf("Error restoring history: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cl.Supervise(ctx)
+	go ackRegisters(cl, store)
+	go func() {
+		for e := range cl.Events {
+			if e.Err != nil {
+				log.Infof("Connection %s: %v", e.State, e.Err)
+				continue
+			}
+			log.Infof("Connection %s", e.State)
+		}
+	}()
+
+	log.Infof("Serving HTTP API on %s", listen)
+	return http.ListenAndServe(listen, httpapi.New(cl))
+}
+
+// Acknowledges register updates from the car, which
+// otherwise keeps resending them.
+func ackRegisters(cl *client.Client, store *history.Store) {
+	for msg := range cl.Recv {
+		if msg.Type != protocol.CmdInResp || msg.Ack != protocol.Request {
+			continue
+		}
+		recordHistory(store, cl.ModelYear, msg)
+		cl.Send <- &protocol.PhevMessage{
+			Type:     protocol.CmdOutSend,
+			Register: msg.Register,
+			Ack:      protocol.Ack,
+			Xor:      msg.Xor,
+			Data:     []byte{0x0},
+		}
+	}
+}
+
+func init() {
+	clientCmd.AddCommand(httpCmd)
+
+	httpCmd.Flags().String("http_listen", ":8081", "Address to serve the HTTP API on")
+	addHistoryFlags(httpCmd)
+
+	viper.BindPFlag("http_listen", httpCmd.Flags().Lookup("http_listen"))
+}
@@ -0,0 +1,110 @@
+//go:build pcap
+
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/session"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// How long to wait for missing segments before skipping them.
+const liveFlushAge = 2 * time.Second
+
+// liveCmd represents the live command
+var liveCmd = &cobra.Command{
+	Use:   "live",
+	Short: "Decode traffic captured live from a network interface",
+	Long: `Captures packets to and from the car on a network interface,
+such as a router between the app and the car, and decodes them
+as they arrive.
+
+TCP streams are reassembled before decoding, so retransmitted and
+out of order segments are handled. Each connection is tracked
+separately, with its own security key.
+`,
+	Args: cobra.NoArgs,
+	RunE: runLive,
+}
+
+func runLive(cmd *cobra.Command, args []string) error {
+	iface, _ := cmd.Flags().GetString("interface")
+	filter, _ := cmd.Flags().GetString("filter")
+	promisc, _ := cmd.Flags().GetBool("promiscuous")
+
+	handle, err := pcap.OpenLive(iface, 65536, promisc, pcap.BlockForever)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(filter); err != nil {
+		return err
+	}
+	log.Infof("%%PHEV_LIVE_START%% Capturing on %s, filter %q", iface, filter)
+
+	a := newPhevAssembly(cmd)
+	if path, _ := cmd.Flags().GetString("record"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		a.recorder = session.NewWriter(f)
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(a))
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				assembler.FlushAll()
+				return nil
+			}
+			tcp, ok := packet.TransportLayer().(*layers.TCP)
+			if !ok || packet.NetworkLayer() == nil {
+				continue
+			}
+			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+		case <-ticker.C:
+			// Skip lost segments, rather than wait for them.
+			assembler.FlushOlderThan(time.Now().Add(-liveFlushAge))
+		}
+	}
+}
+
+func init() {
+	decodeCmd.AddCommand(liveCmd)
+
+	liveCmd.Flags().StringP("interface", "i", "wlan0", "Network interface to capture on")
+	liveCmd.Flags().StringP("filter", "f", "tcp port 8080", "BPF filter for packets to capture")
+	liveCmd.Flags().Bool("promiscuous", false, "Capture in promiscuous mode")
+	liveCmd.Flags().StringP("direction", "d", "both", "Direction to decode")
+	liveCmd.Flags().BoolP("pings", "P", false, "Show ping requests and responses")
+	liveCmd.Flags().String("record", "", "File to append the session to, for emulator replay")
+}
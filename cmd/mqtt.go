@@ -17,15 +17,20 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/history"
 	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -46,52 +51,36 @@ more details on the topics.
 `,
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		mc := &mqttClient{climate: new(climate)}
+		mc := &mqttClient{vehicle: vehicle.New()}
 		return mc.Run(cmd, args)
 	},
 }
 
-// Tracks complete climate state as on and mode are separately
-// sent by the car.
-type climate struct {
-	state *protocol.PreACState
-	mode  *string
-}
-
-func (c *climate) setMode(m string) {
-	c.mode = &m
-}
-func (c *climate) setState(state protocol.PreACState) {
-	c.state = &state
-}
-
-func (c *climate) mqttStates() map[string]string {
+// Returns the climate topics for the climate state. The car sends
+// the state and mode separately, so these only make sense together.
+func climateStates(c vehicle.Climate) map[string]string {
 	m := map[string]string{
 		"/climate/state":      "off",
 		"/climate/cool":       "off",
 		"/climate/heat":       "off",
 		"/climate/windscreen": "off",
 	}
-	if c.mode == nil || c.state == nil {
+	if c.Mode == "" || c.Updated.IsZero() {
 		return m
 	}
-	switch *c.state {
-	case protocol.PreACOn: m["/climate/state"] = *c.mode
-	case protocol.PreACOff: {
-		m["/climate/state"] = "off"
+	switch c.State {
+	case protocol.PreACOn:
+	case protocol.PreACOff:
 		return m
-	}
-	case protocol.PreACTerminated: {
+	case protocol.PreACTerminated:
 		m["/climate/state"] = "terminated"
 		return m
-	}
-	default: {
+	default:
 		m["/climate/state"] = "unknown"
 		return m
 	}
-	}
-	m["/climate/state"] = *c.mode
-	switch *c.mode {
+	m["/climate/state"] = c.Mode
+	switch c.Mode {
 	case "cool":
 		m["/climate/cool"] = "on"
 	case "heat":
@@ -147,8 +136,19 @@ type mqttClient struct {
 	haDiscoveryPrefix	string
 	haPublishedDiscovery	bool
 
-	climate *climate
+	vehicle *vehicle.Vehicle
 	enabled bool
+
+	history  *history.Store
+	sessions *history.SessionTracker
+	trips    *history.TripDetector
+	// Publish as retained values.
+	retain bool
+	// Topics published as retained values, which stay retained so
+	// the broker does not keep serving a stale value.
+	retained map[string]bool
+	// Held while running a command to the car.
+	commandMu sync.Mutex
 }
 
 func (m *mqttClient) topic(topic string) string {
@@ -200,11 +200,23 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 	if token := m.client.Subscribe(m.topic("/connection"), 0, nil); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
-	if token := m.client.Subscribe(m.topic("/settings/#"), 0, nil); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
 
 	m.mqttData = map[string]string{}
+	m.retained = map[string]bool{}
+
+	store, err := openHistory(cmd)
+	if err != nil {
+		return err
+	}
+	m.history = store
+	m.sessions = history.NewSessionTracker(viper.GetFloat64("battery_capacity"))
+	m.trips = history.NewTripDetector()
+	if m.history != nil {
+		defer m.history.Close()
+		if err := m.restoreHistory(); err != nil {
+			log.Errorf("Error restoring history: %v", err)
+		}
+	}
 
 	for {
 		if m.enabled {
@@ -231,9 +243,74 @@ func (m *mqttClient) Run(cmd *cobra.Command, args []string) error {
 	}
 }
 
+// Publishes the last known state from history as retained values,
+// so it is available before the car connects. Live updates to these
+// topics are then retained too, replacing the restored values.
+// Any charge session in progress is restored too.
+func (m *mqttClient) restoreHistory() error {
+	entries, err := restoreHistory(m.history, m.vehicle)
+	if err != nil {
+		return err
+	}
+	m.retain = true
+	defer func() { m.retain = false }()
+	for _, e := range entries {
+		msg := protocol.NewRegisterMessage(e.Register, e.ModelYear, e.Data)
+		if msg.Err != nil {
+			log.Warnf("Skipping malformed register from history: %v", msg.Err)
+			continue
+		}
+		m.publishRegister(msg)
+		m.trackTrip(e)
+	}
+	return m.sessions.Restore(m.history, time.Now().Add(-sessionRestorePeriod))
+}
+
+// How far back to look for a charge session in progress at startup.
+var sessionRestorePeriod = 7 * 24 * time.Hour
+
+// Publishes completed charge sessions as JSON.
+func (m *mqttClient) trackChargeSession(msg *protocol.PhevMessage) {
+	s := m.sessions.Update(history.Entry{Time: time.Now(), Register: msg.Register, Data: msg.Data, ModelYear: m.phev.ModelYear})
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Errorf("Error encoding charge session: %v", err)
+		return
+	}
+	log.Infof("Charge session completed: %s", data)
+	m.publish("/charge/session", string(data))
+}
+
+// Publishes completed trips as JSON, and when the car was parked.
+func (m *mqttClient) trackTrip(e history.Entry) {
+	parked := m.trips.ParkedSince()
+	if t := m.trips.Update(e); t != nil {
+		data, err := json.Marshal(t)
+		if err != nil {
+			log.Errorf("Error encoding trip: %v", err)
+			return
+		}
+		log.Infof("Trip completed: %s", data)
+		m.publish("/trip/last", string(data))
+	}
+	if p := m.trips.ParkedSince(); !p.Equal(parked) {
+		since := ""
+		if !p.IsZero() {
+			since = p.Format(time.RFC3339)
+		}
+		m.publish("/vehicle/parked_since", since)
+	}
+}
+
 func (m *mqttClient) publish(topic, payload string) {
+	if m.retain {
+		m.retained[topic] = true
+	}
 //	if cache := m.mqttData[topic]; cache != payload {
-		m.client.Publish(m.topic(topic), 0, false, payload)
+		m.client.Publish(m.topic(topic), 0, m.retained[topic], payload)
 		m.mqttData[topic] = payload
 //	}
 }
@@ -257,10 +334,9 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			log.Infof("Bad payload [%s]: %v", msg.Payload(), err)
 			return
 		}
-		if err := m.phev.SetRegister(register[0], data); err != nil {
-			log.Infof("Error setting register %02x: %v", register[0], err)
-			return
-		}
+		m.runCommand(fmt.Sprintf("setting register %02x", register[0]), func(ctx context.Context, phev *client.Client) error {
+			return phev.SetRegister(ctx, register[0], data)
+		})
 	} else if msg.Topic() == m.topic("/connection") {
 		payload := strings.ToLower(string(msg.Payload()))
 		switch payload {
@@ -276,115 +352,181 @@ func (m *mqttClient) handleIncomingMqtt(mqtt_client mqtt.Client, msg mqtt.Messag
 			m.phev.Close()
 		}
 	} else if msg.Topic() == m.topic("/set/parkinglights") {
-		values := map[string]byte{"on": 0x1, "off": 0x2}
+		values := map[string]bool{"on": true, "off": false}
 		if v, ok := values[strings.ToLower(string(msg.Payload()))]; ok {
-			if err := m.phev.SetRegister(0xb, []byte{v}); err != nil {
-				log.Infof("Error setting register 0xb: %v", err)
-				return
-			}
+			m.runCommand("setting parking lights", func(ctx context.Context, phev *client.Client) error {
+				_, err := phev.SetParkingLights(ctx, v)
+				return err
+			})
 		}
 	} else if msg.Topic() == m.topic("/set/headlights") {
-		values := map[string]byte{"on": 0x1, "off": 0x2}
+		values := map[string]bool{"on": true, "off": false}
 		if v, ok := values[strings.ToLower(string(msg.Payload()))]; ok {
-			if err := m.phev.SetRegister(0xa, []byte{v}); err != nil {
-				log.Infof("Error setting register 0xb: %v", err)
-				return
-			}
+			m.runCommand("setting head lights", func(ctx context.Context, phev *client.Client) error {
+				_, err := phev.SetHeadlights(ctx, v)
+				return err
+			})
 		}
 	} else if msg.Topic() == m.topic("/set/cancelchargetimer") {
-		if err := m.phev.SetRegister(0x17, []byte{0x1}); err != nil {
-			log.Infof("Error setting register 0x17: %v", err)
-			return
-		}
-		if err := m.phev.SetRegister(0x17, []byte{0x11}); err != nil {
-			log.Infof("Error setting register 0x17: %v", err)
-			return
-		}
+		m.runCommand("cancelling charge timer", func(ctx context.Context, phev *client.Client) error {
+			return phev.CancelChargeTimer(ctx)
+		})
+	} else if strings.HasPrefix(msg.Topic(), m.topic("/set/climate/timer/")) {
+		slot, payload := topicParts[len(topicParts)-1], string(msg.Payload())
+		m.runCommand("setting climate timer", func(ctx context.Context, phev *client.Client) error {
+			return m.setClimateTimer(ctx, phev, slot, payload)
+		})
 	} else if strings.HasPrefix(msg.Topic(), m.topic("/set/climate/state")) {
 		payload := strings.ToLower(string(msg.Payload()))
 		if payload == "reset" {
-			if err := m.phev.SetRegister(protocol.SetAckPreACTermRegister, []byte{0x1}); err != nil {
-				log.Infof("Error acknowledging Pre-AC termination: %v", err)
-				return
-			}
+			m.runCommand("acknowledging Pre-AC termination", func(ctx context.Context, phev *client.Client) error {
+				_, err := phev.AcknowledgePreACTermination(ctx)
+				return err
+			})
 		}
 	} else if strings.HasPrefix(msg.Topic(), m.topic("/set/climate/")) {
-		topic := msg.Topic()
 		payload := strings.ToLower(string(msg.Payload()))
-
-		modeMap := map[string]byte{"off": 0x0, "OFF": 0x0, "cool": 0x1, "heat": 0x2, "windscreen": 0x3, "mode": 0x4}
-		durMap := map[string]byte{"10": 0x0, "20": 0x1, "30": 0x2, "on": 0x0, "off": 0x0}
-		parts := strings.Split(topic, "/")
-		mode, ok := modeMap[parts[len(parts)-1]]
-		if !ok {
-			log.Errorf("Unknown climate mode: %s", parts[len(parts)-1])
-			return
-		}
-		if mode == 0x4 { // set/climate/mode -> "heat"
-			mode = modeMap[payload]
+		mode := strings.ToLower(topicParts[len(topicParts)-1])
+		if mode == "mode" { // set/climate/mode -> "heat"
+			mode = payload
 			payload = "on"
 		}
-		if payload == "off" {
-			mode = 0x0
+		if mode == "off" || payload == "off" {
+			m.runCommand("stopping climate", func(ctx context.Context, phev *client.Client) error {
+				_, err := phev.StopClimate(ctx)
+				return err
+			})
+			return
 		}
+		climateMode, err := client.ParseClimateMode(mode)
+		if err != nil {
+			log.Errorf("Unknown climate mode: %s", mode)
+			return
+		}
+		durMap := map[string]time.Duration{"10": 10 * time.Minute, "20": 20 * time.Minute, "30": 30 * time.Minute, "on": 10 * time.Minute}
 		duration, ok := durMap[payload]
-		if mode != 0x0 && !ok {
+		if !ok {
 			log.Errorf("Unknown climate duration: %s", payload)
 			return
 		}
-
-		if m.phev.ModelYear == client.ModelYear14 {
-			// Set the AC mode first
-			registerPayload := bytes.Repeat([]byte{0xff}, 15)
-			registerPayload[0] = 0x0
-			registerPayload[1] = 0x0
-			registerPayload[6] = mode | duration
-			if err := m.phev.SetRegister(protocol.SetACModeRegisterMY14, registerPayload); err != nil {
-				log.Infof("Error setting AC mode: %v", err)
-				return
-			}
-
-			// Then, enable/disable the AC
-			acEnabled := byte(0x02)
-			if mode == 0x0 {
-				acEnabled = 0x01
-			}
-			if err := m.phev.SetRegister(protocol.SetACEnabledRegisterMY14, []byte{acEnabled}); err != nil {
-				log.Infof("Error setting AC enabled state: %v", err)
-				return
-			}
-		} else if m.phev.ModelYear == client.ModelYear18 || m.phev.ModelYear == client.ModelYear24 {
-			state := byte(0x02)
-			if mode == 0x0 {
-				state = 0x1
-			}
-			if err := m.phev.SetRegister(protocol.SetACModeRegisterMY18, []byte{state, mode, duration, 0x0}); err != nil {
-				log.Infof("Error setting AC mode: %v", err)
-				return
-			}
+		m.runCommand("starting climate", func(ctx context.Context, phev *client.Client) error {
+			_, err := phev.StartClimate(ctx, climateMode, duration)
+			return err
+		})
+	} else if strings.HasPrefix(msg.Topic(), m.topic("/set/settings/")) {
+		id, err := protocol.SettingID(topicParts[len(topicParts)-1])
+		if err != nil {
+			log.Infof("Bad setting in topic [%s]: %v", msg.Topic(), err)
+			return
+		}
+		// The value written to the car, not the raw value it reports.
+		value, err := strconv.ParseUint(strings.TrimSpace(string(msg.Payload())), 10, 8)
+		if err != nil {
+			log.Infof("Bad setting value [%s]: %v", msg.Payload(), err)
+			return
 		}
-	} else if msg.Topic() == m.topic("/settings/dump") {
-		log.Infof("CURRENT_SETTINGS:")
-		log.Infof("\n%s", m.phev.Settings.Dump())
-		m.phev.Settings.Clear()
+		if err := protocol.CheckSettingValue(id, byte(value)); err != nil {
+			log.Infof("Bad setting value [%s]: %v", msg.Payload(), err)
+			return
+		}
+		m.runCommand("applying setting "+protocol.SettingName(id), func(ctx context.Context, phev *client.Client) error {
+			return phev.ApplySetting(ctx, id, byte(value))
+		})
 	} else {
 		log.Errorf("Unknown topic from mqtt: %s", msg.Topic())
 	}
 }
 
+var commandTimeout = time.Minute
+
+// Runs a command to the car, one at a time, apart from the MQTT
+// client which waits for each message handler to return.
+func (m *mqttClient) runCommand(name string, f func(ctx context.Context, phev *client.Client) error) {
+	phev := m.phev
+	go func() {
+		m.commandMu.Lock()
+		defer m.commandMu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		if err := f(ctx, phev); err != nil {
+			log.Infof("Error %s: %v", name, err)
+		}
+	}()
+}
+
+// Updates climate timer slot (1-5) from the payload, which is one of
+// "on", "off", "unset" or "HH:MM <duration> <days>", e.g
+// "07:50 20 mon,tue,wed".
+func (m *mqttClient) setClimateTimer(ctx context.Context, phev *client.Client, slot, payload string) error {
+	n, err := strconv.Atoi(slot)
+	if err != nil || n < 1 || n > 5 {
+		return fmt.Errorf("bad climate timer %q", slot)
+	}
+	current := m.vehicle.State().Timers.Climate
+	if len(current) != 5 {
+		return fmt.Errorf("climate timers not yet received from car")
+	}
+	timers := &protocol.RegisterClimateTimer{}
+	for i := range current {
+		timers.Timers = append(timers.Timers, &current[i])
+	}
+	timer := *timers.Timers[n-1]
+	payload = strings.ToLower(strings.TrimSpace(payload))
+	switch payload {
+	case "on", "off":
+		if timer.State == protocol.TimerUnset {
+			return fmt.Errorf("climate timer %d is not set", n)
+		}
+		timer.State = protocol.TimerEnabled
+		if payload == "off" {
+			timer.State = protocol.TimerDisabled
+		}
+	case "unset":
+		timer = *protocol.UnsetClimateTimer()
+	default:
+		fields := strings.Fields(payload)
+		if len(fields) != 3 {
+			return fmt.Errorf("bad payload %q, want \"HH:MM <duration> <days>\"", payload)
+		}
+		var hour, minute int
+		if _, err := fmt.Sscanf(fields[0], "%d:%d", &hour, &minute); err != nil {
+			return fmt.Errorf("bad time %q: %v", fields[0], err)
+		}
+		duration, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("bad duration %q: %v", fields[1], err)
+		}
+		days, err := protocol.ParseWeekdays(fields[2])
+		if err != nil {
+			return err
+		}
+		t, err := protocol.NewClimateTimer(hour, minute, duration, days)
+		if err != nil {
+			return err
+		}
+		timer = *t
+	}
+	timers.Timers[n-1] = &timer
+	data, err := timers.SetPayload()
+	if err != nil {
+		return err
+	}
+	return phev.SetRegister(ctx, protocol.SetClimateTimerRegister, data)
+}
+
 func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 	var err error
 	address := viper.GetString("address")
-	m.phev, err = client.New(client.AddressOption(address))
+	m.phev, err = client.New(client.AddressOption(address), client.VehicleOption(m.vehicle))
 	if err != nil {
 		return err
 	}
 
-	if err := m.phev.Connect(); err != nil {
+	if err := m.phev.Connect(context.Background()); err != nil {
 		return err
 	}
 
-	if err := m.phev.Start(); err != nil {
+	if err := m.phev.Start(context.Background()); err != nil {
 		return err
 	}
 	m.client.Publish(m.topic("/available"), 0, true, "online")
@@ -402,7 +544,7 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 	for {
 		select {
 		case <-updaterTicker.C:
-			m.phev.SetRegister(0x6, []byte{0x3})
+			m.phev.SetRegister(context.Background(), 0x6, []byte{0x3})
 		case msg, ok := <-m.phev.Recv:
 			if !ok {
 				log.Infof("Connection closed.")
@@ -425,7 +567,15 @@ func (m *mqttClient) handlePhev(cmd *cobra.Command) error {
 				if msg.Ack != protocol.Request {
 					break
 				}
-				m.publishRegister(msg)
+				if msg.Err != nil {
+					// Still acked, so the car does not resend it.
+					log.Warnf("Skipping malformed register: %v", msg.Err)
+				} else {
+					m.publishRegister(msg)
+					recordHistory(m.history, m.phev.ModelYear, msg)
+					m.trackChargeSession(msg)
+					m.trackTrip(history.Entry{Time: time.Now(), Register: msg.Register, Data: msg.Data, ModelYear: m.phev.ModelYear})
+				}
 				m.phev.Send <- &protocol.PhevMessage{
 					Type:     protocol.CmdOutSend,
 					Register: msg.Register,
@@ -450,64 +600,75 @@ var boolOpen = map[bool]string{
 func (m *mqttClient) publishRegister(msg *protocol.PhevMessage) {
 	dataStr := hex.EncodeToString(msg.Data)
 	m.publish(fmt.Sprintf("/register/%02x", msg.Register), dataStr)
+	state := m.vehicle.State()
 	switch reg := msg.Reg.(type) {
 	case *protocol.RegisterVIN:
-		m.publish("/vin", reg.VIN)
-		m.publishHomeAssistantDiscovery(reg.VIN, m.prefix, "Phev")
-		m.publish("/registrations", fmt.Sprintf("%d", reg.Registrations))
+		m.publish("/vin", state.VIN)
+		m.publishHomeAssistantDiscovery(state.VIN, m.prefix, "Phev")
+		m.publish("/registrations", fmt.Sprintf("%d", state.Registrations))
 	case *protocol.RegisterECUVersion:
-		m.publish("/ecuversion", reg.Version)
-	case *protocol.RegisterACMode:
-		m.climate.setMode(reg.Mode)
-		for t, p := range m.climate.mqttStates() {
-			m.publish(t, p)
-		}
-	case *protocol.RegisterPreACState:
-		m.climate.setState(reg.State)
-		for t, p := range m.climate.mqttStates() {
+		m.publish("/ecuversion", state.ECUVersion)
+	case *protocol.RegisterACMode, *protocol.RegisterPreACState:
+		for t, p := range climateStates(state.Climate) {
 			m.publish(t, p)
 		}
+	case *protocol.RegisterACOperStatus:
+		m.publish("/vehicle/ignition", state.Ignition.State.String())
 	case *protocol.RegisterChargeStatus:
-		m.publish("/charge/charging", boolOnOff[reg.Charging])
-		if reg.Remaining < 1000 {
-			m.publish("/charge/remaining", fmt.Sprintf("%d", reg.Remaining))
-		} else {
-			log.Debugf("Ignoring charge remanining reading: %v", reg.Remaining)
-			if cache := m.mqttData["/charge/remaining"]; cache != "" {
-				m.publish("/charge/remaining", cache)
-				log.Debugf("Publishing last best known charge remaining reading: %v", cache)
-			}
+		m.publish("/charge/charging", boolOnOff[state.Charge.Charging])
+		// Nothing to publish until the car reports a plausible time.
+		if !state.Charge.RemainingUpdated.IsZero() {
+			m.publish("/charge/remaining", fmt.Sprintf("%d", state.Charge.Remaining))
 		}
 	case *protocol.RegisterDoorStatus:
-		m.publish("/door/locked", boolOpen[!reg.Locked])
-		m.publish("/door/rear_left", boolOpen[reg.RearLeft])
-		m.publish("/door/rear_right", boolOpen[reg.RearRight])
-		m.publish("/door/front_right", boolOpen[reg.Driver])
-		m.publish("/door/driver", boolOpen[reg.Driver])
-		m.publish("/door/front_left", boolOpen[reg.FrontPassenger])
-		m.publish("/door/front_passenger", boolOpen[reg.FrontPassenger])
-		m.publish("/door/bonnet", boolOpen[reg.Bonnet])
-		m.publish("/door/boot", boolOpen[reg.Boot])
-		m.publish("/lights/head", boolOnOff[reg.Headlights])
+		m.publish("/door/locked", boolOpen[!state.Doors.Locked])
+		m.publish("/door/rear_left", boolOpen[state.Doors.RearLeft])
+		m.publish("/door/rear_right", boolOpen[state.Doors.RearRight])
+		m.publish("/door/front_right", boolOpen[state.Doors.Driver])
+		m.publish("/door/driver", boolOpen[state.Doors.Driver])
+		m.publish("/door/front_left", boolOpen[state.Doors.FrontPassenger])
+		m.publish("/door/front_passenger", boolOpen[state.Doors.FrontPassenger])
+		m.publish("/door/bonnet", boolOpen[state.Doors.Bonnet])
+		m.publish("/door/boot", boolOpen[state.Doors.Boot])
+		m.publish("/lights/head", boolOnOff[state.Lights.Head])
 	case *protocol.RegisterBatteryLevel:
-		if (reg.Level > 5) && (reg.Level < 255) {
-			m.publish("/battery/level", fmt.Sprintf("%d", reg.Level))
+		// Bogus levels are not recorded, so publish the last good one.
+		if !state.Battery.Updated.IsZero() {
+			m.publish("/battery/level", fmt.Sprintf("%d", state.Battery.Level))
 		} else {
-			if cache := m.mqttData["/battery/level"]; cache != "" {
-				m.publish("/battery/level", cache )
-				log.Debugf("Ignoring battery level reading: %v, publishing last best known: %v", reg.Level, cache)
-			}
+			log.Debugf("Ignoring battery level reading: %v", reg.Level)
 		}
-		m.publish("/lights/parking", boolOnOff[reg.ParkingLights])
+		m.publish("/lights/parking", boolOnOff[state.Lights.Parking])
 	case *protocol.RegisterLightStatus:
-		m.publish("/lights/interior", boolOnOff[reg.Interior])
-		m.publish("/lights/hazard", boolOnOff[reg.Hazard])
+		m.publish("/lights/interior", boolOnOff[state.Lights.Interior])
+		m.publish("/lights/hazard", boolOnOff[state.Lights.Hazard])
 	case *protocol.RegisterChargePlug:
-		if reg.Connected {
+		if state.Plug.Connected {
 			m.publish("/charge/plug", "connected")
 		} else {
 			m.publish("/charge/plug", "unplugged")
 		}
+	case *protocol.RegisterSettings:
+		for _, s := range reg.Settings {
+			// Not the value ApplySetting takes, so raw only.
+			m.publish("/settings/"+s.Name()+"/raw", fmt.Sprintf("%02x", s.Value))
+		}
+	case *protocol.RegisterClimateTimer:
+		for i, t := range state.Timers.Climate {
+			prefix := fmt.Sprintf("/climate/timer/%d", i+1)
+			m.publish(prefix+"/state", t.State.String())
+			m.publish(prefix+"/time", t.Time())
+			m.publish(prefix+"/duration", fmt.Sprintf("%d", t.Duration))
+			m.publish(prefix+"/days", t.Days.String())
+		}
+	case *protocol.RegisterChargeTimer:
+		for i, t := range state.Timers.Charge {
+			prefix := fmt.Sprintf("/charge/timer/%d", i+1)
+			m.publish(prefix+"/state", t.State.String())
+			m.publish(prefix+"/start", t.Start())
+			m.publish(prefix+"/stop", t.Stop())
+			m.publish(prefix+"/days", t.Days.String())
+		}
 	}
 }
 
@@ -851,6 +1012,7 @@ func init() {
 	mqttCmd.Flags().Duration("wifi_restart_time", 0, "Attempt to restart Wifi if no connection for this long")
 	mqttCmd.Flags().Duration("wifi_restart_retry_time", 2*time.Minute, "Interval to attempt Wifi restart")
 	mqttCmd.Flags().String("wifi_restart_command", defaultWifiRestartCmd, "Command to restart Wifi connection to Phev")
+	addHistoryFlags(mqttCmd)
 
 	viper.BindPFlag("mqtt_server", mqttCmd.Flags().Lookup("mqtt_server"))
 	viper.BindPFlag("mqtt_username", mqttCmd.Flags().Lookup("mqtt_username"))
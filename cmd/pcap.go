@@ -23,13 +23,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/session"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -41,11 +43,17 @@ var pcapCmd = &cobra.Command{
 	Long: `Reads packets from a PCAP file generated by a packet sniffer
 such as Wireshark.
 
-The decoder filters TCP packets to and from port 8080.
+The decoder filters TCP packets to and from port 8080, and
+reassembles each TCP connection before decoding, so messages
+split over segments, retransmits and out of order segments are
+handled. Each connection has its own security key.
 
 This can also read files from a TCP connection. Specify
 "tcp:<address>:<port>". This can be useful for realtime monitoring
 via Android (https://wladimir-tm4pda.github.io/porting/tcpdump.html)
+
+If --record is specified, the traffic is also written to the file
+in the session format of the proxy command, for emulator replay.
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -71,11 +79,19 @@ via Android (https://wladimir-tm4pda.github.io/porting/tcpdump.html)
 			log.Fatal(err)
 		}
 		defer handle.Close()
-		securityKey = &protocol.SecurityKey{}
-		pings, _ = cmd.Flags().GetBool("pings")
+		a := newPhevAssembly(cmd)
+		if path, _ := cmd.Flags().GetString("record"); path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			a.recorder = session.NewWriter(f)
+		}
+		assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(a))
 
 		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-		var currentTime time.Time
+		var currentTime, flushTime time.Time
 		pNum := 0
 		for packet := range packetSource.Packets() {
 			if m := packet.Metadata(); m != nil {
@@ -89,81 +105,31 @@ via Android (https://wladimir-tm4pda.github.io/porting/tcpdump.html)
 				}
 			}
 			pNum += 1
-			decodePacket(cmd, packet)
+			assemblePacket(assembler, packet, currentTime)
+			if currentTime.Sub(flushTime) > time.Second {
+				// Skip segments missing from the capture, by capture time.
+				assembler.FlushOlderThan(currentTime.Add(-liveFlushAge))
+				flushTime = currentTime
+			}
 		}
+		assembler.FlushAll()
 	},
 }
 
-func decodePacket(cmd *cobra.Command, packet gopacket.Packet) {
-	dir := "?"
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer != nil {
-		tcp, _ := tcpLayer.(*layers.TCP)
-		if tcp.SrcPort == 8080 {
-			dir = "in  "
-		} else if tcp.DstPort == 8080 {
-			dir = "out "
-		}
-		if tcp.SYN && tcp.ACK {
-			log.Infof("TCP-SYN-ACK\n")
-		}
-		if tcp.FIN {
-			log.Infof("TCP-FIN\n")
-		}
-		if tcp.RST {
-			log.Infof("TCP-RST\n")
-		}
+// Passes TCP packets to and from the car to the assembler.
+func assemblePacket(assembler *tcpassembly.Assembler, packet gopacket.Packet, t time.Time) {
+	if err := packet.ErrorLayer(); err != nil {
+		log.Errorf("error decoding packet: %v", err.Error())
 	}
-
-	d, _ := cmd.Flags().GetString("direction")
-	if dir == "in  " && d == "out" {
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || packet.NetworkLayer() == nil {
 		return
 	}
-	if dir == "out " && d == "in" {
+	if tcp.SrcPort != 8080 && tcp.DstPort != 8080 {
 		return
 	}
-
-	al := packet.ApplicationLayer()
-	if al != nil {
-		processPayload(cmd, al.Payload(), dir)
-	}
-
-	if err := packet.ErrorLayer(); err != nil {
-		log.Errorf("error decoding packet:", err)
-	}
-}
-
-func processPayload(cmd *cobra.Command, data []byte, dir string) {
-	log.Tracef("%%PHEV_PCAP_RAW_%s%%: %s\n", strings.ToUpper(dir), hex.EncodeToString(data))
-	msgs := protocol.NewFromBytes(data, securityKey)
-	for _, msg := range msgs {
-		if r, _ := cmd.Flags().GetBool("registers"); r {
-			handleRegisters(msg)
-			return
-		}
-		if !pings && (msg.Type == protocol.CmdOutPingReq || msg.Type == protocol.CmdInPingResp) {
-			return
-		}
-		log.Infof("%s [%02x] %s", dir, msg.Xor, msg.ShortForm())
-	}
-}
-
-var regs = map[byte]string{}
-
-var pings bool
-
-func handleRegisters(m *protocol.PhevMessage) {
-	if m.Type == protocol.CmdInResp {
-		data := hex.EncodeToString(m.Data)
-		if d := regs[m.Register]; d != data {
-			if m.Reg != nil {
-				log.Infof("UPDATEREG 0x%02x: %s -> %s (%s)\n", m.Register, d, data, m.Reg.String())
-			} else {
-				log.Infof("UPDATEREG 0x%02x: %s -> %s\n", m.Register, d, data)
-			}
-			regs[m.Register] = data
-		}
-	}
+	log.Tracef("%%PHEV_PCAP_RAW%%: %s", hex.EncodeToString(tcp.Payload))
+	assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, t)
 }
 
 func init() {
@@ -182,4 +148,5 @@ func init() {
 	pcapCmd.Flags().BoolP("latency", "l", false, "Replay with original network latency")
 	pcapCmd.Flags().BoolP("registers", "R", false, "Show register updates")
 	pcapCmd.Flags().BoolP("pings", "P", false, "Show ping requests and responses")
+	pcapCmd.Flags().String("record", "", "File to write the session to, for emulator replay")
 }
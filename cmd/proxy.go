@@ -0,0 +1,204 @@
+/*
+Copyright © 2021 Ben Buxton <bbuxton@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/session"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// proxyCmd represents the proxy command
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Proxy and decode traffic between a client and the car",
+	Long: `Listens for a client, such as the official app or phev2mqtt, and
+forwards its connection to the car, decoding and logging the messages
+in both directions as they pass.
+
+Point the client at this host, for example by running the proxy on a
+device that joins the car wifi and forwarding the app to it.
+
+If --record is specified, the traffic is appended to the file, as one
+JSON record per line, for later replay.
+`,
+	RunE: runProxy,
+}
+
+type proxy struct {
+	car      string
+	pings    bool
+	recorder *session.Writer
+	// Numbers the connections.
+	conns int
+	mu    sync.Mutex
+}
+
+func runProxy(cmd *cobra.Command, args []string) error {
+	listen, _ := cmd.Flags().GetString("listen")
+	p := &proxy{}
+	p.car, _ = cmd.Flags().GetString("car")
+	p.pings, _ = cmd.Flags().GetBool("pings")
+	if path, _ := cmd.Flags().GetString("record"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		p.recorder = session.NewWriter(f)
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Infof("%%PHEV_PROXY_START%% Proxying %s to %s", listen, p.car)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.conns++
+		id := p.conns
+		p.mu.Unlock()
+		go p.handle(id, conn)
+	}
+}
+
+// Forwards a client connection to the car until either side closes.
+func (p *proxy) handle(id int, conn net.Conn) {
+	defer conn.Close()
+	log.Infof("%%PHEV_PROXY_CONNECT%% [%d] Client connected from %s", id, conn.RemoteAddr())
+	car, err := net.DialTimeout("tcp", p.car, 10*time.Second)
+	if err != nil {
+		log.Errorf("%%PHEV_PROXY_DIAL%% [%d] Error connecting to car: %v", id, err)
+		return
+	}
+	defer car.Close()
+
+	// Both directions share one key, which tracks the send and
+	// receive streams separately.
+	f := &flow{id: id, proxy: p, key: &protocol.SecurityKey{}}
+	done := make(chan struct{}, 2)
+	go func() {
+		f.copy(car, conn, session.Out)
+		done <- struct{}{}
+	}()
+	go func() {
+		f.copy(conn, car, session.In)
+		done <- struct{}{}
+	}()
+	<-done
+	log.Infof("%%PHEV_PROXY_DISCONNECT%% [%d] Connection closed", id)
+}
+
+// A flow is one proxied connection.
+type flow struct {
+	id    int
+	proxy *proxy
+	key   *protocol.SecurityKey
+	// Held while decoding with key.
+	mu sync.Mutex
+}
+
+// Copies data from src to dst, decoding and recording it.
+func (f *flow) copy(dst io.Writer, src io.Reader, dir string) {
+	// Messages may be split across reads, so decode the stream.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go f.decode(dir, pr)
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			if _, err := dst.Write(data); err != nil {
+				log.Debugf("[%d] %s write error: %v", f.id, dir, err)
+				return
+			}
+			f.record(dir, data)
+			pw.Write(data)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("[%d] %s read error: %v", f.id, dir, err)
+			}
+			return
+		}
+	}
+}
+
+func (f *flow) record(dir string, data []byte) {
+	if f.proxy.recorder == nil {
+		return
+	}
+	if err := f.proxy.recorder.Write(session.NewRecord(time.Now(), f.id, dir, data)); err != nil {
+		log.Errorf("%%PHEV_PROXY_RECORD%% Error recording: %v", err)
+	}
+}
+
+// Decodes and logs the messages in one direction, until r closes.
+func (f *flow) decode(dir string, r io.Reader) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := protocol.NewDecoder(&unlockedReader{r: r, mu: &f.mu}, f.key)
+	if dir == session.In {
+		dir = "in "
+	}
+	for {
+		msg, err := d.Decode()
+		if err != nil {
+			return
+		}
+		if !f.proxy.pings && (msg.Type == protocol.CmdOutPingReq || msg.Type == protocol.CmdInPingResp) {
+			continue
+		}
+		log.Infof("[%d] %s [%02x] %s", f.id, dir, msg.Xor, msg.ShortForm())
+	}
+}
+
+// unlockedReader releases the lock while waiting for data, so both
+// directions decode with the shared key in turn.
+type unlockedReader struct {
+	r  io.Reader
+	mu *sync.Mutex
+}
+
+func (u *unlockedReader) Read(p []byte) (int, error) {
+	u.mu.Unlock()
+	defer u.mu.Lock()
+	return u.r.Read(p)
+}
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+
+	proxyCmd.Flags().String("listen", ":8080", "Address to listen for clients on")
+	proxyCmd.Flags().String("car", client.DefaultAddress, "Address of the car")
+	proxyCmd.Flags().String("record", "", "File to append the recorded session to")
+	proxyCmd.Flags().BoolP("pings", "P", false, "Show ping requests and responses")
+}
@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"time"
 
 	"github.com/buxtronix/phev2mqtt/client"
@@ -65,16 +66,12 @@ func runRegister(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	if err := cl.Connect(); err != nil {
+	if err := cl.Connect(context.Background()); err != nil {
 		panic(err)
 	}
 
-	if err := cl.Start(); err != nil {
-		panic(err)
-	}
-	log.Infof("Client connected and started!")
-
-	vinCh := make(chan string)
+	// Read messages while starting, so the reader is not blocked.
+	vinCh := make(chan string, 1)
 
 	go func() {
 		for {
@@ -91,7 +88,10 @@ func runRegister(cmd *cobra.Command, args []string) {
 						break
 					}
 					if reg, ok := msg.Reg.(*protocol.RegisterVIN); ok {
-						vinCh <- reg.VIN
+						select {
+						case vinCh <- reg.VIN:
+						default:
+						}
 					}
 					cl.Send <- &protocol.PhevMessage{
 						Type:     protocol.CmdOutSend,
@@ -105,20 +105,25 @@ func runRegister(cmd *cobra.Command, args []string) {
 		}
 	}()
 
+	if err := cl.Start(context.Background()); err != nil {
+		panic(err)
+	}
+	log.Infof("Client connected and started!")
+
 	vin, ok := <-vinCh
 	if !ok {
 		log.Errorf("Client closed before recieving VIN")
 		return
 	}
 
-	reg := byte(0x10)
+	reg := byte(protocol.SetRegisterClientRegister)
 	if cmd.Use == "unregister" {
 		log.Infof("Attempting to unregister from car (VIN: %s)...", vin)
-		reg = 0x15
+		reg = protocol.SetUnregisterClientRegister
 	} else {
 		log.Infof("Attempting to register to car (VIN: %s)...", vin)
 	}
-	if err := cl.SetRegister(reg, []byte{0x1}); err != nil {
+	if err := cl.SetRegister(context.Background(), reg, []byte{0x1}); err != nil {
 		log.Errorf("Failed to (un)register: %v", err)
 		return
 	}
@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"encoding/hex"
 	"strings"
 	"time"
@@ -86,21 +87,21 @@ func runSet(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	if err := cl.Connect(); err != nil {
+	if err := cl.Connect(context.Background()); err != nil {
 		panic(err)
 	}
 
-	if err := cl.Start(); err != nil {
+	if err := cl.Start(context.Background()); err != nil {
 		panic(err)
 	}
 	log.Infof("Client connected and started!")
-	log.Infof("Waiting %d", waitTime.String())
+	log.Infof("Waiting %s", waitTime.String())
 
 	time.Sleep(waitTime)
 
 	for _, reg := range setRegisters {
 		log.Infof("Setting register 0x%x to 0x%s", reg.register, hex.EncodeToString(reg.value))
-		if err := cl.SetRegister(reg.register, reg.value); err != nil {
+		if err := cl.SetRegister(context.Background(), reg.register, reg.value); err != nil {
 			panic(err)
 		}
 		time.Sleep(sendInterval)
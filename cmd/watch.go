@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	"encoding/hex"
 	"time"
 
@@ -42,11 +43,11 @@ func Run(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
-	if err := cl.Connect(); err != nil {
+	if err := cl.Connect(context.Background()); err != nil {
 		panic(err)
 	}
 
-	if err := cl.Start(); err != nil {
+	if err := cl.Start(context.Background()); err != nil {
 		panic(err)
 	}
 
@@ -61,6 +62,9 @@ func Run(cmd *cobra.Command, args []string) {
 			}
 			switch m.Type {
 			case protocol.CmdInResp:
+				if m.Err != nil {
+					log.Warnf("%%PHEV_REG_MALFORMED%% %02x: %v", m.Register, m.Err)
+				}
 				dataStr := hex.EncodeToString(m.Data)
 				if data := registers[m.Register]; data != dataStr {
 					log.Infof("%%PHEV_REG_UPDATE%% %02x: %s -> %s", m.Register, data, dataStr)
@@ -3,11 +3,14 @@ package emulator
 import (
 	"encoding/hex"
 	"fmt"
+	"github.com/buxtronix/phev2mqtt/client"
 	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -18,9 +21,26 @@ type Car struct {
 	// Registers are the current registers and settings for Car.
 	Registers []protocol.Register
 	// Settings are the vehicle settings.
-	Settings    *protocol.Settings
-	address     string
-	connections []*Connection
+	Settings *protocol.Settings
+	// Vehicle is the vehicle state, as the registers describe it.
+	Vehicle *vehicle.Vehicle
+	// ModelYear selects the start messages and register lengths.
+	ModelYear client.ModelYear
+	// Faults are injected into client connections.
+	Faults Faults
+	// Registered client IDs, and whether to reject other clients.
+	registered          map[string]bool
+	enforceRegistration bool
+	registrationMode    bool
+	address             string
+	connections         []*Connection
+	// Stops the climate control after its duration.
+	climateTimer *time.Timer
+	// The AC mode set by a MY14 client, until it enables the AC.
+	my14ACMode byte
+	// Guards Registers, connections, climateTimer, my14ACMode and
+	// registration.
+	mu sync.Mutex
 }
 
 // Begin starts the emulator.
@@ -36,11 +56,16 @@ func (c *Car) Begin() error {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				log.Errorf("Accept() error: %v")
+				log.Errorf("Accept() error: %v", err)
 				return
 			}
 			svc := NewConnection(conn, c)
-			c.connections = append(c.connections, svc)
+			if err := c.checkClient(svc.clientID()); err != nil {
+				log.Infof("%%PHEV_EMULATOR_REJECT%% Rejecting connection: %v", err)
+				conn.Close()
+				continue
+			}
+			c.addConnection(svc)
 
 			go svc.Start()
 		}
@@ -49,20 +74,98 @@ func (c *Car) Begin() error {
 	return nil
 }
 
-// SetRegister sends a register to client.
+// Returns a copy of the registers.
+func (c *Car) registers() []protocol.Register {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]protocol.Register{}, c.Registers...)
+}
+
+// RegisterData returns the current value of the register, or nil
+// if the car does not have it.
+func (c *Car) RegisterData(register byte) []byte {
+	var data []byte
+	for _, r := range c.registers() {
+		if r.Register() == register {
+			data = append([]byte{}, r.Encode().Data...)
+		}
+	}
+	return data
+}
+
+// MY14 cars send shorter values for some registers.
+var my14RegisterLengths = map[byte]int{
+	protocol.PreACStateRegister:   1,
+	protocol.ACOperStatusRegister: 2,
+}
+
+// Returns the value as the car model year sends it.
+func (c *Car) registerValue(register byte, value []byte) []byte {
+	if l, ok := my14RegisterLengths[register]; ok && c.ModelYear == client.ModelYear14 && len(value) > l {
+		value = value[:l]
+	}
+	return append([]byte{}, value...)
+}
+
+// Returns the start request and expected response types for the
+// model year.
+func (c *Car) startTypes() (byte, byte) {
+	switch c.ModelYear {
+	case client.ModelYear14:
+		return protocol.CmdInMy14StartReq, protocol.CmdOutMy14StartResp
+	case client.ModelYear24:
+		return protocol.CmdInMy24StartReq, protocol.CmdOutMy24StartResp
+	default:
+		return protocol.CmdInMy18StartReq, protocol.CmdOutMy18StartResp
+	}
+}
+
+// UpdateRegister changes the value of a register, and sends it to
+// connected clients. New clients receive the updated value.
+func (c *Car) UpdateRegister(register byte, value []byte) error {
+	value = c.registerValue(register, value)
+	reg := &protocol.RegisterGeneric{Reg: register, Value: value}
+	c.mu.Lock()
+	found := false
+	for i, r := range c.Registers {
+		if r.Register() == register {
+			c.Registers[i] = reg
+			found = true
+		}
+	}
+	if !found {
+		c.Registers = append(c.Registers, reg)
+	}
+	c.mu.Unlock()
+	c.Vehicle.Update(protocol.NewRegisterMessage(register, c.ModelYear, value))
+	return c.SetRegister(register, value)
+}
+
+// SetRegister sends a register to clients that are receiving or have
+// received the initial registers. Clients still receiving them may
+// already have the old value.
 func (c *Car) SetRegister(register byte, value []byte) error {
 	g := new(errgroup.Group)
-	for _, conn := range c.connections {
+	c.mu.Lock()
+	connections := append([]*Connection{}, c.connections...)
+	c.mu.Unlock()
+	for _, conn := range connections {
+		if st := conn.getState(); st != conRegisterStart && st != conEstablished {
+			continue
+		}
+		conn := conn
 		g.Go(func() error {
 			timer := time.After(10 * time.Second)
 			l := conn.AddListener()
 			defer conn.RemoveListener(l)
 		SETREG:
-			conn.Send <- protocol.NewMessage(protocol.CmdInResp, register, false, value)
+			conn.send(protocol.NewMessage(protocol.CmdInResp, register, false, value))
 			for {
 				select {
 				case <-timer:
 					return fmt.Errorf("timed out attempting to set register %02x", register)
+				case <-conn.done:
+					return fmt.Errorf("connection closed setting register %02x", register)
 				case msg, ok := <-l.C:
 					if !ok {
 						return fmt.Errorf("listener channel closed")
@@ -90,15 +193,41 @@ func AddressOption(address string) func(*Car) {
 	}
 }
 
+// ModelYearOption configures the model year to emulate, MY18 if not set.
+func ModelYearOption(year client.ModelYear) func(*Car) {
+	return func(c *Car) {
+		c.ModelYear = year
+	}
+}
+
 // NewCar returns a new Car. You get a Car! Everyone gets a Car!
 func NewCar(opts ...Option) (*Car, error) {
 	c := &Car{
-		Registers: defaultRegisters,
-		Settings:  &protocol.Settings{},
+		Registers:  append([]protocol.Register{}, defaultRegisters...),
+		Settings:   &protocol.Settings{},
+		Vehicle:    vehicle.New(),
+		ModelYear:  client.ModelYear18,
+		registered: map[string]bool{},
 	}
 	for _, o := range opts {
 		o(c)
 	}
+	for i, r := range c.Registers {
+		if _, ok := my14RegisterLengths[r.Register()]; ok {
+			r = &protocol.RegisterGeneric{Reg: r.Register(), Value: c.registerValue(r.Register(), r.Encode().Data)}
+			c.Registers[i] = r
+		}
+		c.Vehicle.Update(protocol.NewRegisterMessage(r.Register(), c.ModelYear, r.Encode().Data))
+	}
+	if len(c.registered) > 0 {
+		if err := c.setRegistrations(len(c.registered)); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Settings.All()) > 0 {
+		// Configured by an option.
+		return c, nil
+	}
 	for _, s := range defaultSettings {
 		setting, err := hex.DecodeString(s)
 		if err != nil {
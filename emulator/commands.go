@@ -0,0 +1,132 @@
+package emulator
+
+import (
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handles a register write from a client, updating the registers that
+// a real car changes in response.
+func (c *Car) handleCommand(id string, register byte, data []byte) error {
+	if len(data) < 1 {
+		return nil
+	}
+	if c.ModelYear == client.ModelYear14 {
+		switch register {
+		case protocol.SetACModeRegisterMY14:
+			if len(data) < 7 {
+				return nil
+			}
+			// Assume the same layout as the AC mode register.
+			c.mu.Lock()
+			c.my14ACMode = data[6]
+			c.mu.Unlock()
+			return nil
+		case protocol.SetACEnabledRegisterMY14:
+			if data[0] != 0x2 {
+				return c.stopClimate(protocol.PreACOff)
+			}
+			c.mu.Lock()
+			mode := c.my14ACMode
+			c.mu.Unlock()
+			duration := 10 * time.Duration(mode>>4+1) * time.Minute
+			return c.startClimate(acModes[mode&0x0f], duration)
+		}
+	}
+	switch register {
+	case protocol.SetACModeRegisterMY18:
+		if len(data) < 3 {
+			return nil
+		}
+		if data[0] == 0x2 {
+			duration := 10 * time.Duration(data[2]+1) * time.Minute
+			return c.startClimate(acModes[data[1]], duration)
+		}
+		return c.stopClimate(protocol.PreACOff)
+	case protocol.SetRegisterClientRegister:
+		return c.setRegistered(id, true)
+	case protocol.SetUnregisterClientRegister:
+		return c.setRegistered(id, false)
+	case protocol.SetAckPreACTermRegister:
+		r := &protocol.RegisterPreACState{}
+		if err := c.register(protocol.PreACStateRegister, r); err != nil {
+			return err
+		}
+		if r.State == protocol.PreACTerminated {
+			return c.setPreAC(protocol.PreACOff)
+		}
+	case protocol.SetHeadlightsRegister:
+		r := &protocol.RegisterDoorStatus{}
+		if err := c.register(protocol.DoorStatusRegister, r); err != nil {
+			return err
+		}
+		r.Headlights = data[0] == 0x1
+		return c.updateRegister(r)
+	case protocol.SetParkingLightsRegister:
+		r := &protocol.RegisterBatteryLevel{}
+		if err := c.register(protocol.BatteryLevelRegister, r); err != nil {
+			return err
+		}
+		r.ParkingLights = data[0] == 0x1
+		return c.updateRegister(r)
+	}
+	return nil
+}
+
+var acModes = map[byte]string{
+	0x1: "cool",
+	0x2: "heat",
+	0x3: "windscreen",
+}
+
+// Starts the climate control, stopping it again after the duration.
+func (c *Car) startClimate(mode string, duration time.Duration) error {
+	if mode == "" {
+		mode = "unknown"
+	}
+	c.mu.Lock()
+	if c.climateTimer != nil {
+		c.climateTimer.Stop()
+	}
+	c.climateTimer = time.AfterFunc(duration, func() {
+		if err := c.stopClimate(protocol.PreACOff); err != nil {
+			log.Errorf("%%PHEV_EMULATOR_CLIMATE%% Error stopping climate: %v", err)
+		}
+	})
+	c.mu.Unlock()
+	log.Infof("%%PHEV_EMULATOR_CLIMATE%% Climate on, mode=%s duration=%v", mode, duration)
+	if err := c.updateRegister(&protocol.RegisterACMode{Mode: mode, Duration: uint8(duration / time.Minute)}); err != nil {
+		return err
+	}
+	if err := c.setACOperating(true); err != nil {
+		return err
+	}
+	return c.setPreAC(protocol.PreACOn)
+}
+
+// Stops the climate control, leaving it in the given state.
+func (c *Car) stopClimate(state protocol.PreACState) error {
+	c.mu.Lock()
+	if c.climateTimer != nil {
+		c.climateTimer.Stop()
+		c.climateTimer = nil
+	}
+	c.mu.Unlock()
+	log.Infof("%%PHEV_EMULATOR_CLIMATE%% Climate %s", state)
+	if err := c.setACOperating(false); err != nil {
+		return err
+	}
+	return c.setPreAC(state)
+}
+
+func (c *Car) setACOperating(on bool) error {
+	r := &protocol.RegisterACOperStatus{}
+	if err := c.register(protocol.ACOperStatusRegister, r); err != nil {
+		return err
+	}
+	r.Operating = on
+	return c.updateRegister(r)
+}
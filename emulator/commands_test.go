@@ -0,0 +1,213 @@
+package emulator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
+)
+
+func TestHandleCommand(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		year     client.ModelYear
+		writes   []registerWrite
+		terminal bool
+		check    func(s vehicle.VehicleState) bool
+	}{
+		{
+			name:   "MY18 climate on",
+			year:   client.ModelYear18,
+			writes: []registerWrite{{protocol.SetACModeRegisterMY18, []byte{0x2, 0x2, 0x1, 0x0}}},
+			check: func(s vehicle.VehicleState) bool {
+				return s.Climate.State == protocol.PreACOn && s.Climate.Operating && s.Climate.Mode == "heat" && s.Climate.Duration == 20
+			},
+		},
+		{
+			name: "MY18 climate off",
+			year: client.ModelYear18,
+			writes: []registerWrite{
+				{protocol.SetACModeRegisterMY18, []byte{0x2, 0x1, 0x0, 0x0}},
+				{protocol.SetACModeRegisterMY18, []byte{0x1, 0x0, 0x0, 0x0}},
+			},
+			check: func(s vehicle.VehicleState) bool {
+				return s.Climate.State == protocol.PreACOff && !s.Climate.Operating
+			},
+		},
+		{
+			name: "MY14 climate on",
+			year: client.ModelYear14,
+			writes: []registerWrite{
+				{protocol.SetACModeRegisterMY14, []byte{0x0, 0x0, 0xff, 0xff, 0xff, 0xff, 0x23, 0xff}},
+				{protocol.SetACEnabledRegisterMY14, []byte{0x2}},
+			},
+			check: func(s vehicle.VehicleState) bool {
+				return s.Climate.State == protocol.PreACOn && s.Climate.Operating && s.Climate.Mode == "windscreen" && s.Climate.Duration == 30
+			},
+		},
+		{
+			name:     "acknowledge pre-AC termination",
+			year:     client.ModelYear18,
+			writes:   []registerWrite{{protocol.SetAckPreACTermRegister, []byte{0x1}}},
+			terminal: true,
+			check: func(s vehicle.VehicleState) bool {
+				return s.Climate.State == protocol.PreACOff
+			},
+		},
+		{
+			name:   "head lights",
+			year:   client.ModelYear18,
+			writes: []registerWrite{{protocol.SetHeadlightsRegister, []byte{0x1}}},
+			check:  func(s vehicle.VehicleState) bool { return s.Lights.Head },
+		},
+		{
+			name:   "parking lights",
+			year:   client.ModelYear18,
+			writes: []registerWrite{{protocol.SetParkingLightsRegister, []byte{0x1}}},
+			check:  func(s vehicle.VehicleState) bool { return s.Lights.Parking },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewCar(ModelYearOption(test.year))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.terminal {
+				if err := c.stopClimate(protocol.PreACTerminated); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, w := range test.writes {
+				if err := c.handleCommand("client", w.register, w.value); err != nil {
+					t.Fatalf("handleCommand(%02x) unexpected error: %v", w.register, err)
+				}
+			}
+			if s := c.Vehicle.State(); !test.check(s) {
+				t.Errorf("state got=%+v", s)
+			}
+		})
+	}
+}
+
+type registerWrite struct {
+	register byte
+	value    []byte
+}
+
+// Starts an emulated car on a loopback address, and a client connected
+// to it.
+func startCar(t *testing.T, opts ...Option) (*Car, *client.Client) {
+	t.Helper()
+	// Find a free port, as the car does not report its address.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	c, err := NewCar(append(opts, AddressOption(address))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := client.New(client.AddressOption(address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cl.Close() })
+	if err := cl.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Ack register updates, as the car waits for them.
+	go func() {
+		for m := range cl.Recv {
+			if m.Type == protocol.CmdInResp && m.Ack == protocol.Request {
+				cl.Send <- &protocol.PhevMessage{
+					Type:     protocol.CmdOutSend,
+					Register: m.Register,
+					Ack:      protocol.Ack,
+					Xor:      m.Xor,
+					Data:     []byte{0x0},
+				}
+			}
+		}
+	}()
+	if err := cl.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c, cl
+}
+
+func TestClientCommands(t *testing.T) {
+	for _, year := range []client.ModelYear{client.ModelYear14, client.ModelYear18} {
+		t.Run(year.String(), func(t *testing.T) {
+			c, cl := startCar(t, ModelYearOption(year))
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if cl.ModelYear != year {
+				t.Errorf("ModelYear got=%s want=%s", cl.ModelYear, year)
+			}
+
+			// MY14 clients send the mode and duration in one byte, of
+			// unknown layout, so only 10 minutes is the same both ways.
+			duration := 20 * time.Minute
+			if year == client.ModelYear14 {
+				duration = 10 * time.Minute
+			}
+			if _, err := cl.StartClimate(ctx, client.ClimateHeat, duration); err != nil {
+				t.Errorf("StartClimate() unexpected error: %v", err)
+			}
+			if s := c.Vehicle.State().Climate; s.State != protocol.PreACOn || s.Mode != "heat" || s.Duration != int(duration/time.Minute) {
+				t.Errorf("car climate after StartClimate() got=%+v", s)
+			}
+			if _, err := cl.StopClimate(ctx); err != nil {
+				t.Errorf("StopClimate() unexpected error: %v", err)
+			}
+			if s := c.Vehicle.State().Climate; s.State != protocol.PreACOff || s.Operating {
+				t.Errorf("car climate after StopClimate() got=%+v", s)
+			}
+
+			if err := c.stopClimate(protocol.PreACTerminated); err != nil {
+				t.Fatal(err)
+			}
+			if r, err := cl.AcknowledgePreACTermination(ctx); err != nil {
+				t.Errorf("AcknowledgePreACTermination() unexpected error: %v", err)
+			} else if r.State != protocol.PreACOff {
+				t.Errorf("AcknowledgePreACTermination() got=%s want=%s", r.State, protocol.PreACOff)
+			}
+
+			if r, err := cl.SetHeadlights(ctx, true); err != nil {
+				t.Errorf("SetHeadlights() unexpected error: %v", err)
+			} else if !r.Headlights || !c.Vehicle.State().Lights.Head {
+				t.Errorf("SetHeadlights() got=%v car=%v want on", r.Headlights, c.Vehicle.State().Lights.Head)
+			}
+			if r, err := cl.SetParkingLights(ctx, true); err != nil {
+				t.Errorf("SetParkingLights() unexpected error: %v", err)
+			} else if !r.ParkingLights || !c.Vehicle.State().Lights.Parking {
+				t.Errorf("SetParkingLights() got=%v car=%v want on", r.ParkingLights, c.Vehicle.State().Lights.Parking)
+			}
+
+			if err := cl.CancelChargeTimer(ctx); err != nil {
+				t.Errorf("CancelChargeTimer() unexpected error: %v", err)
+			}
+			if err := cl.ApplySetting(ctx, 0x07, 0x2); err != nil {
+				t.Errorf("ApplySetting() unexpected error: %v", err)
+			}
+
+			c.SetRegistrationMode(true)
+			if err := cl.SetRegister(ctx, protocol.SetRegisterClientRegister, []byte{0x1}); err != nil {
+				t.Errorf("SetRegister(register client) unexpected error: %v", err)
+			}
+			if got := c.RegisteredClients(); len(got) != 1 || got[0] != "127.0.0.1" {
+				t.Errorf("RegisteredClients() got=%v want=[127.0.0.1]", got)
+			}
+		})
+	}
+}
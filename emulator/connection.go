@@ -1,7 +1,6 @@
 package emulator
 
 import (
-	"encoding/hex"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"sync"
@@ -27,8 +26,9 @@ func NewConnection(conn net.Conn, car *Car) *Connection {
 		state: conClosed,
 		car:   car,
 		conn:  conn,
-		key:   &protocol.SecurityKey{},
+		key:   &protocol.SecurityKey{ModelYear: car.ModelYear},
 		Send:  make(chan *protocol.PhevMessage, 5),
+		done:  make(chan struct{}),
 
 		listeners: []*client.Listener{},
 	}
@@ -44,18 +44,64 @@ type Connection struct {
 	listeners []*client.Listener
 	lMu       sync.Mutex
 
+	// state is guarded by sMu, as the writer and the car read it.
 	state connState
+	sMu   sync.Mutex
 
 	registerIndex  int
 	settingsSender *protocol.SettingsSender
+	// The register last sent of the initial registers and settings,
+	// whose ack sends the next.
+	sentRegister byte
+
+	// Closed when the connection closes, to stop its goroutines.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (s *Connection) Close() error {
-	s.state = conClosed
-	if s.conn != nil {
-		return s.conn.Close()
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.setState(conClosed)
+		s.car.removeConnection(s)
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+	})
+	return err
+}
+
+func (s *Connection) getState() connState {
+	s.sMu.Lock()
+	defer s.sMu.Unlock()
+	return s.state
+}
+
+func (s *Connection) setState(state connState) {
+	s.sMu.Lock()
+	defer s.sMu.Unlock()
+	s.state = state
+}
+
+// Changes the state from one to another, returning false if it was
+// in a different state.
+func (s *Connection) changeState(from, to connState) bool {
+	s.sMu.Lock()
+	defer s.sMu.Unlock()
+	if s.state != from {
+		return false
+	}
+	s.state = to
+	return true
+}
+
+// Queues the message to send, unless the connection is closed.
+func (s *Connection) send(msg *protocol.PhevMessage) {
+	select {
+	case s.Send <- msg:
+	case <-s.done:
 	}
-	return nil
 }
 
 // Create and return a new Listener.
@@ -81,56 +127,60 @@ func (s *Connection) RemoveListener(l *client.Listener) {
 }
 
 func (s *Connection) Start() {
-	s.state = conTCPOpen
+	s.setState(conTCPOpen)
 	go s.reader()
 	go s.writer()
 	go s.manage()
 }
 
 func (s *Connection) reader() {
+	dec := protocol.NewDecoder(s.conn, s.key)
 	for {
 		s.conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(30 * time.Second))
-		data := make([]byte, 4096)
-		n, err := s.conn.Read(data)
+		m, err := dec.Decode()
 		if err != nil {
 			log.Debugf("%%PHEV_SVC_READER_ERROR%% %v", err)
-			s.conn.Close()
+			s.Close()
 			return
 		}
-		log.Tracef("%%PHEV_SVC_RECV_RAW%%: %s", hex.EncodeToString(data[:n]))
-		msgs := protocol.NewFromBytes(data[:n], s.key)
-		for _, m := range msgs {
-			if m.Type != protocol.CmdOutPingReq {
-				log.Debugf("%%PHEV_SVC_RCV_MSG%%: %s", m.ShortForm())
-			}
-			s.lMu.Lock()
-			for _, l := range s.listeners {
-				l.Send(m)
-			}
-			s.lMu.Unlock()
+		if m.Type != protocol.CmdOutPingReq {
+			log.Debugf("%%PHEV_SVC_RCV_MSG%%: %s", m.ShortForm())
+		}
+		s.lMu.Lock()
+		for _, l := range s.listeners {
+			l.Send(m)
 		}
+		s.lMu.Unlock()
 	}
 }
 
 func (s *Connection) writer() {
 	for {
 		select {
+		case <-s.done:
+			return
 		case msg, ok := <-s.Send:
 			if !ok {
 				log.Debug("%PHEV_SVC_SEND_CLOSE%")
 				s.Close()
 				return
 			}
+			if s.injectDrop(msg) {
+				continue
+			}
 			if msg.Type != protocol.CmdInPingResp {
 				log.Debugf("%%PHEV_SVC_SND_MSG%%: %s", msg.ShortForm())
 			}
-			data := msg.EncodeToBytes(s.key)
+			data := s.injectCoalesce(msg.EncodeToBytes(s.key))
 			s.conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(15 * time.Second))
-			if _, err := s.conn.Write(data); err != nil {
+			if err := s.write(data); err != nil {
 				log.Debugf("%%PHEV_SVC_WRITE_ERR%%: %v", err)
 				s.Close()
 				return
 			}
+			if s.injectDisconnect() {
+				return
+			}
 		}
 	}
 }
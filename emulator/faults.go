@@ -0,0 +1,136 @@
+package emulator
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// Faults are faults to inject into client connections, to emulate
+// flaky car wifi. Probabilities are from 0 (never) to 1 (always).
+type Faults struct {
+	// Drop is the probability of not sending a message.
+	Drop float64
+	// AckDelay is the maximum random delay before acking a register
+	// write from the client.
+	AckDelay time.Duration
+	// BadEncoding is the probability of responding to a client message
+	// with a bad encoding message, with a wrong expected xor.
+	BadEncoding float64
+	// Rekey is the probability of a new key proposal on each ping.
+	Rekey float64
+	// Split is the probability of splitting a message across TCP
+	// segments.
+	Split float64
+	// Coalesce is the probability of sending queued messages in the
+	// same TCP segment.
+	Coalesce float64
+	// Disconnect is the probability of closing the connection on
+	// each message sent.
+	Disconnect float64
+}
+
+// FaultsOption configures faults to inject into connections.
+func FaultsOption(f Faults) func(*Car) {
+	return func(c *Car) {
+		c.Faults = f
+	}
+}
+
+func chance(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+// Responds to a client message with a bad encoding message, returning
+// true if it did so and the message should be ignored.
+func (s *Connection) injectBadEncoding(msg *protocol.PhevMessage) bool {
+	if msg.Type != protocol.CmdOutSend && msg.Type != protocol.CmdOutPingReq {
+		return false
+	}
+	if s.getState() != conEstablished || !chance(s.car.Faults.BadEncoding) {
+		return false
+	}
+	xor := byte(rand.Intn(256))
+	log.Infof("%%PHEV_SVC_FAULT%% Bad encoding for %s, expecting xor %02x", msg.ShortForm(), xor)
+	s.send(protocol.NewMessage(protocol.CmdInBadEncoding, msg.Register, false, []byte{xor}))
+	return true
+}
+
+// Returns true if the message should be dropped. Only messages after
+// the initial registers are dropped, as the car does not resend those.
+func (s *Connection) injectDrop(msg *protocol.PhevMessage) bool {
+	if s.getState() != conEstablished || !chance(s.car.Faults.Drop) {
+		return false
+	}
+	log.Infof("%%PHEV_SVC_FAULT%% Dropped %s", msg.ShortForm())
+	return true
+}
+
+// Returns how long to delay an ack.
+func (s *Connection) ackDelay() time.Duration {
+	if s.car.Faults.AckDelay <= 0 {
+		return 0
+	}
+	d := time.Duration(rand.Int63n(int64(s.car.Faults.AckDelay)))
+	log.Infof("%%PHEV_SVC_FAULT%% Delaying ack by %v", d)
+	return d
+}
+
+// Rekeys after a ping, returning true if it did so.
+func (s *Connection) injectRekey() bool {
+	if s.getState() != conEstablished || !chance(s.car.Faults.Rekey) {
+		return false
+	}
+	log.Info("%PHEV_SVC_FAULT% Rekeying")
+	s.rekey()
+	return true
+}
+
+// Appends queued messages to the data to send in one segment.
+func (s *Connection) injectCoalesce(data []byte) []byte {
+	if !chance(s.car.Faults.Coalesce) {
+		return data
+	}
+	for n := 1; ; n++ {
+		select {
+		case msg, ok := <-s.Send:
+			if !ok {
+				return data
+			}
+			data = append(data, msg.EncodeToBytes(s.key)...)
+		default:
+			if n > 1 {
+				log.Infof("%%PHEV_SVC_FAULT%% Coalesced %d messages", n)
+			}
+			return data
+		}
+	}
+}
+
+// Writes the data, possibly split over two TCP segments.
+func (s *Connection) write(data []byte) error {
+	if len(data) > 1 && chance(s.car.Faults.Split) {
+		n := 1 + rand.Intn(len(data)-1)
+		log.Infof("%%PHEV_SVC_FAULT%% Splitting write at %d/%d bytes", n, len(data))
+		if _, err := s.conn.Write(data[:n]); err != nil {
+			return err
+		}
+		// Give the segment time to go out alone.
+		time.Sleep(50 * time.Millisecond)
+		data = data[n:]
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+// Closes the connection, returning true if it did so.
+func (s *Connection) injectDisconnect() bool {
+	if !chance(s.car.Faults.Disconnect) {
+		return false
+	}
+	log.Info("%PHEV_SVC_FAULT% Disconnecting")
+	s.Close()
+	return true
+}
@@ -0,0 +1,141 @@
+package emulator
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegisteredClientsOption configures the clients already registered
+// with the car. The car registers MAC addresses, which are not visible
+// over TCP, so the emulator identifies clients by IP address instead.
+func RegisteredClientsOption(ids ...string) func(*Car) {
+	return func(c *Car) {
+		for _, id := range ids {
+			c.registered[id] = true
+		}
+	}
+}
+
+// EnforceRegistrationOption makes the car reject connections from
+// unregistered clients, unless in registration mode.
+func EnforceRegistrationOption(enforce bool) func(*Car) {
+	return func(c *Car) {
+		c.enforceRegistration = enforce
+	}
+}
+
+// RegistrationModeOption starts the car in registration mode, where
+// clients may register.
+func RegistrationModeOption(on bool) func(*Car) {
+	return func(c *Car) {
+		c.registrationMode = on
+	}
+}
+
+// SetRegistrationMode turns registration mode on or off.
+func (c *Car) SetRegistrationMode(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registrationMode = on
+}
+
+// RegisteredClients returns the registered client IDs, in order.
+func (c *Car) RegisteredClients() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := []string{}
+	for id := range c.registered {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Returns the client ID of the connection, its IP address.
+func (s *Connection) clientID() string {
+	addr := s.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Returns an error if the connection should be rejected.
+func (c *Car) checkClient(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enforceRegistration || c.registered[id] || c.registrationMode {
+		return nil
+	}
+	return fmt.Errorf("client %s is not registered", id)
+}
+
+// Adds the connection, closing any others as the car only talks to
+// one client at a time.
+func (c *Car) addConnection(conn *Connection) {
+	c.mu.Lock()
+	old := c.connections
+	c.connections = []*Connection{conn}
+	c.mu.Unlock()
+	for _, o := range old {
+		log.Infof("%%PHEV_EMULATOR_CLOSE_OLD%% Closing connection from %s for new client", o.clientID())
+		o.Close()
+	}
+}
+
+// Removes a closed connection.
+func (c *Car) removeConnection(conn *Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	connections := []*Connection{}
+	for _, o := range c.connections {
+		if o != conn {
+			connections = append(connections, o)
+		}
+	}
+	c.connections = connections
+}
+
+// Returns an error if the client may not write the register, so the
+// write is not acked.
+func (c *Car) checkCommand(id string, register byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if register == protocol.SetRegisterClientRegister && !c.registrationMode {
+		return fmt.Errorf("client %s: not in registration mode", id)
+	}
+	return nil
+}
+
+// Registers or unregisters the client, returning an error if not
+// allowed.
+func (c *Car) setRegistered(id string, registered bool) error {
+	c.mu.Lock()
+	if registered && !c.registrationMode {
+		c.mu.Unlock()
+		return fmt.Errorf("not in registration mode")
+	}
+	if registered {
+		c.registered[id] = true
+	} else {
+		delete(c.registered, id)
+	}
+	count := len(c.registered)
+	c.mu.Unlock()
+	log.Infof("%%PHEV_EMULATOR_REGISTRATION%% Client %s registered=%v, %d registered clients", id, registered, count)
+	return c.setRegistrations(count)
+}
+
+// Updates the registration count in the VIN register.
+func (c *Car) setRegistrations(count int) error {
+	data := c.RegisterData(protocol.VINRegister)
+	if len(data) != 20 {
+		return nil
+	}
+	data[19] = byte(count)
+	return c.UpdateRegister(protocol.VINRegister, data)
+}
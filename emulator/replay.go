@@ -0,0 +1,205 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Replay is the car's side of a recorded session, to emulate the
+// car that was recorded.
+type Replay struct {
+	// ModelYear is from the car's start request, if recorded.
+	ModelYear client.ModelYear
+	// Registers are the first value the car sent for each register,
+	// in the order sent.
+	Registers []protocol.Register
+	// Settings are the settings registers the car sent.
+	Settings [][]byte
+	// Updates are later changes to the registers.
+	Updates []ReplayUpdate
+}
+
+// A ReplayUpdate is a register changed by the car during the session.
+type ReplayUpdate struct {
+	// At is the time since the start of the session.
+	At       time.Duration
+	Register byte
+	Data     []byte
+}
+
+// LoadReplay loads a session recorded by the proxy or pcap decoder.
+func LoadReplay(path string) (*Replay, error) {
+	records, err := session.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReplay(records)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return r, nil
+}
+
+// A recordReader reads the data of records in turn, with the time of
+// the record last read from.
+type recordReader struct {
+	records []session.Record
+	pending []byte
+	time    time.Time
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if len(r.records) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.records[0].Bytes()
+		if err != nil {
+			return 0, err
+		}
+		r.pending, r.time = data, r.records[0].Time
+		r.records = r.records[1:]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// A replayMessage is a message from the car, at the time its last
+// byte was recorded.
+type replayMessage struct {
+	time time.Time
+	msg  *protocol.PhevMessage
+}
+
+// Decodes the messages from the car in each connection, as a stream
+// so messages split across records are decoded. Returns them in time
+// order.
+func replayMessages(records []session.Record) ([]replayMessage, error) {
+	conns := map[int][]session.Record{}
+	order := []int{}
+	for _, rec := range records {
+		if rec.Dir != session.In {
+			continue
+		}
+		if _, ok := conns[rec.Conn]; !ok {
+			order = append(order, rec.Conn)
+		}
+		conns[rec.Conn] = append(conns[rec.Conn], rec)
+	}
+	msgs := []replayMessage{}
+	for _, conn := range order {
+		r := &recordReader{records: conns[conn]}
+		d := protocol.NewDecoder(r, &protocol.SecurityKey{})
+		for {
+			msg, err := d.Decode()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, replayMessage{time: r.time, msg: msg})
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].time.Before(msgs[j].time) })
+	return msgs, nil
+}
+
+// NewReplay decodes the recorded traffic into a Replay. Only traffic
+// from the car is needed, as the xor of each message is known from it.
+func NewReplay(records []session.Record) (*Replay, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records in session")
+	}
+	msgs, err := replayMessages(records)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{}
+	values := map[byte][]byte{}
+	settings := map[string]bool{}
+	start := records[0].Time
+	for _, m := range msgs {
+		msg := m.msg
+		if year := protocol.StartModelYear(msg.Type); year != protocol.ModelYearUnknown {
+			r.ModelYear = year
+		}
+		if msg.Type != protocol.CmdInResp || msg.Ack != protocol.Request {
+			continue
+		}
+		if msg.Register == protocol.SettingsRegister {
+			if !settings[string(msg.Data)] {
+				settings[string(msg.Data)] = true
+				r.Settings = append(r.Settings, append([]byte{}, msg.Data...))
+			}
+			continue
+		}
+		value, seen := values[msg.Register]
+		switch {
+		case !seen:
+			r.Registers = append(r.Registers, &protocol.RegisterGeneric{Reg: msg.Register, Value: append([]byte{}, msg.Data...)})
+		case !bytes.Equal(value, msg.Data):
+			r.Updates = append(r.Updates, ReplayUpdate{
+				At:       m.time.Sub(start),
+				Register: msg.Register,
+				Data:     append([]byte{}, msg.Data...),
+			})
+		default:
+			// Resent on reconnect or for a missing ack.
+			continue
+		}
+		values[msg.Register] = append([]byte{}, msg.Data...)
+	}
+	if len(r.Registers) == 0 {
+		return nil, fmt.Errorf("no registers from the car in session")
+	}
+	return r, nil
+}
+
+// ReplayOption configures the car with the registers and settings of
+// the replay, and its model year if recorded.
+func ReplayOption(r *Replay) func(*Car) {
+	return func(c *Car) {
+		c.Registers = append([]protocol.Register{}, r.Registers...)
+		if r.ModelYear != client.ModelYearUnknown {
+			c.ModelYear = r.ModelYear
+		}
+		if len(r.Settings) > 0 {
+			c.Settings = &protocol.Settings{}
+			for _, s := range r.Settings {
+				if err := c.Settings.FromRegister(s); err != nil {
+					log.Errorf("%%PHEV_EMULATOR_REPLAY%% Bad settings register %x: %v", s, err)
+				}
+			}
+		}
+	}
+}
+
+// RunReplay sends the register updates of the replay to clients, with
+// their original timing from when it is called.
+func (c *Car) RunReplay(ctx context.Context, r *Replay) error {
+	log.Infof("%%PHEV_EMULATOR_REPLAY%% Replaying %d register updates", len(r.Updates))
+	start := time.Now()
+	for _, u := range r.Updates {
+		if err := sleep(ctx, time.Until(start.Add(u.At))); err != nil {
+			return err
+		}
+		log.Infof("%%PHEV_EMULATOR_REPLAY%% Register %02x: %x", u.Register, u.Data)
+		if err := c.UpdateRegister(u.Register, u.Data); err != nil {
+			// Clients may not be connected, so carry on.
+			log.Errorf("%%PHEV_EMULATOR_REPLAY%% Register %02x: %v", u.Register, err)
+		}
+	}
+	log.Info("%PHEV_EMULATOR_REPLAY% Replay complete")
+	return nil
+}
@@ -0,0 +1,100 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/session"
+)
+
+func carMessage(t *testing.T, register byte, data string) []byte {
+	t.Helper()
+	return protocol.NewRegisterMessage(register, protocol.ModelYearUnknown, mustHex(t, data)).EncodeToBytes(&protocol.SecurityKey{})
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNewReplay(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &protocol.SecurityKey{}
+	startReq := protocol.NewMessage(protocol.CmdInMy14StartReq, 0x1, false, append(key.GenerateProposal(), 0x1)).EncodeToBytes(&protocol.SecurityKey{})
+	battery := carMessage(t, protocol.BatteryLevelRegister, "50000000")
+	doors := carMessage(t, protocol.DoorStatusRegister, "0100000000000000000000")
+	records := []session.Record{
+		session.NewRecord(start, 1, session.In, startReq),
+		session.NewRecord(start, 1, session.Out, []byte{0xf3, 0x04, 0x00, 0x0a}),
+		session.NewRecord(start.Add(time.Second), 1, session.In, append(battery, carMessage(t, protocol.SettingsRegister, "023a003b003c0000")...)),
+		// Split across records.
+		session.NewRecord(start.Add(2*time.Second), 1, session.In, doors[:3]),
+		session.NewRecord(start.Add(3*time.Second), 1, session.In, doors[3:]),
+		// Resent on reconnect.
+		session.NewRecord(start.Add(4*time.Second), 2, session.In, append(battery, carMessage(t, protocol.SettingsRegister, "023a003b003c0000")...)),
+		session.NewRecord(start.Add(5*time.Second), 2, session.In, carMessage(t, protocol.BatteryLevelRegister, "51000000")),
+	}
+	r, err := NewReplay(records)
+	if err != nil {
+		t.Fatalf("NewReplay() unexpected error: %v", err)
+	}
+	if r.ModelYear != client.ModelYear14 {
+		t.Errorf("ModelYear got=%s want=%s", r.ModelYear, client.ModelYear14)
+	}
+	if len(r.Registers) != 2 || r.Registers[0].Register() != protocol.BatteryLevelRegister || r.Registers[1].Register() != protocol.DoorStatusRegister {
+		t.Errorf("Registers got=%v want battery level then doors", r.Registers)
+	} else if got := r.Registers[1].Encode().Data; !bytes.Equal(got, mustHex(t, "0100000000000000000000")) {
+		t.Errorf("doors got=%x", got)
+	}
+	if len(r.Settings) != 1 || !bytes.Equal(r.Settings[0], mustHex(t, "023a003b003c0000")) {
+		t.Errorf("Settings got=%x want one", r.Settings)
+	}
+	want := ReplayUpdate{At: 5 * time.Second, Register: protocol.BatteryLevelRegister, Data: mustHex(t, "51000000")}
+	if len(r.Updates) != 1 || r.Updates[0].At != want.At || r.Updates[0].Register != want.Register || !bytes.Equal(r.Updates[0].Data, want.Data) {
+		t.Errorf("Updates got=%+v want=[%+v]", r.Updates, want)
+	}
+
+	c, err := NewCar(ReplayOption(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ModelYear != client.ModelYear14 || !bytes.Equal(c.RegisterData(protocol.BatteryLevelRegister), mustHex(t, "50000000")) {
+		t.Errorf("car got model year=%s battery=%x", c.ModelYear, c.RegisterData(protocol.BatteryLevelRegister))
+	}
+}
+
+func TestNewReplayErrors(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		records []session.Record
+		wantErr string
+	}{
+		{name: "empty", wantErr: "no records"},
+		{
+			name:    "client only",
+			records: []session.Record{session.NewRecord(start, 1, session.Out, carMessage(t, protocol.BatteryLevelRegister, "50000000"))},
+			wantErr: "no registers",
+		},
+		{
+			name:    "bad data",
+			records: []session.Record{{Time: start, Conn: 1, Dir: session.In, Data: "0g"}},
+			wantErr: "invalid byte",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewReplay(test.records); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("NewReplay() got err=%v want containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
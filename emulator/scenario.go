@@ -0,0 +1,318 @@
+package emulator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// A Scenario is a timeline of changes to the car, to script
+// behaviours such as charging or opening doors.
+//
+// An example scenario file:
+//
+//	name: Evening charge
+//	steps:
+//	  - action: plug_in
+//	  - after: 5s
+//	    action: charge
+//	    from: 40
+//	    to: 100
+//	    duration: 10m
+//	  - after: 1m
+//	    action: open_door
+//	    door: driver
+//	  - after: 10s
+//	    register: "1d"
+//	    data: "50000000"
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Loop repeats the steps until stopped.
+	Loop  bool   `yaml:"loop"`
+	Steps []Step `yaml:"steps"`
+}
+
+// A Step is a single change to the car. It either sets a register to
+// raw data, or performs an action.
+type Step struct {
+	// After is the delay before the step, from the end of the
+	// previous step.
+	After time.Duration `yaml:"after"`
+	// Register and Data are hex strings.
+	Register string `yaml:"register"`
+	Data     string `yaml:"data"`
+	// Action is one of the actions below.
+	Action string `yaml:"action"`
+	// From and To are battery levels in percent, for charge.
+	From int `yaml:"from"`
+	To   int `yaml:"to"`
+	// Level is the battery level in percent, for battery.
+	Level int `yaml:"level"`
+	// Duration is how long to charge for, or the pre-AC duration of
+	// 10, 20 or 30 minutes.
+	Duration time.Duration `yaml:"duration"`
+	// Door is driver, front_passenger, rear_left, rear_right, bonnet
+	// or boot, for open_door and close_door.
+	Door string `yaml:"door"`
+	// Mode is the pre-AC mode, cool, heat or windscreen.
+	Mode string `yaml:"mode"`
+	// Ignition is off, acc or on, for ignition.
+	Ignition string `yaml:"ignition"`
+}
+
+// Actions run by a step. Each is given the parameters from the step.
+var actions = map[string]func(c *Car, ctx context.Context, s *Step) error{
+	"plug_in":         func(c *Car, ctx context.Context, s *Step) error { return c.setPlug(true) },
+	"unplug":          func(c *Car, ctx context.Context, s *Step) error { return c.setPlug(false) },
+	"charge":          (*Car).charge,
+	"stop_charge":     func(c *Car, ctx context.Context, s *Step) error { return c.setCharging(false, 0) },
+	"battery":         func(c *Car, ctx context.Context, s *Step) error { return c.setBatteryLevel(s.Level) },
+	"open_door":       func(c *Car, ctx context.Context, s *Step) error { return c.setDoor(s.Door, true) },
+	"close_door":      func(c *Car, ctx context.Context, s *Step) error { return c.setDoor(s.Door, false) },
+	"lock":            func(c *Car, ctx context.Context, s *Step) error { return c.setLocked(true) },
+	"unlock":          func(c *Car, ctx context.Context, s *Step) error { return c.setLocked(false) },
+	"preac_start":     (*Car).startPreAC,
+	"preac_stop":      func(c *Car, ctx context.Context, s *Step) error { return c.stopClimate(protocol.PreACOff) },
+	"preac_terminate": func(c *Car, ctx context.Context, s *Step) error { return c.stopClimate(protocol.PreACTerminated) },
+	"ignition":        (*Car).setIgnition,
+}
+
+var doors = map[string]func(*protocol.RegisterDoorStatus) *bool{
+	"driver":          func(r *protocol.RegisterDoorStatus) *bool { return &r.Driver },
+	"front_passenger": func(r *protocol.RegisterDoorStatus) *bool { return &r.FrontPassenger },
+	"rear_left":       func(r *protocol.RegisterDoorStatus) *bool { return &r.RearLeft },
+	"rear_right":      func(r *protocol.RegisterDoorStatus) *bool { return &r.RearRight },
+	"bonnet":          func(r *protocol.RegisterDoorStatus) *bool { return &r.Bonnet },
+	"boot":            func(r *protocol.RegisterDoorStatus) *bool { return &r.Boot },
+}
+
+var ignitionStates = map[string]protocol.IgnitionState{
+	"off": protocol.IgnitionOff,
+	"acc": protocol.IgnitionAcc,
+	"on":  protocol.IgnitionOn,
+}
+
+// LoadScenario reads a scenario from a YAML or JSON file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(data)
+}
+
+// ParseScenario parses a YAML or JSON scenario, and checks its steps.
+func ParseScenario(data []byte) (*Scenario, error) {
+	s := &Scenario{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, fmt.Errorf("parsing scenario: %v", err)
+	}
+	for i := range s.Steps {
+		if err := s.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Step) validate() error {
+	if s.Action == "" {
+		if len(s.Register) != 2 {
+			return fmt.Errorf("one of action or register is required")
+		}
+		if _, err := hex.DecodeString(s.Register); err != nil {
+			return fmt.Errorf("bad register %q: %v", s.Register, err)
+		}
+		if _, err := hex.DecodeString(s.Data); err != nil {
+			return fmt.Errorf("bad data %q: %v", s.Data, err)
+		}
+		return nil
+	}
+	if _, ok := actions[s.Action]; !ok {
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	switch s.Action {
+	case "charge":
+		if s.From < 0 || s.To > 100 || s.From >= s.To {
+			return fmt.Errorf("charge needs 0 <= from < to <= 100")
+		}
+	case "battery":
+		if s.Level < 0 || s.Level > 100 {
+			return fmt.Errorf("bad battery level %d", s.Level)
+		}
+	case "open_door", "close_door":
+		if _, ok := doors[s.Door]; !ok {
+			return fmt.Errorf("unknown door %q", s.Door)
+		}
+	case "preac_start":
+		if s.Mode != "cool" && s.Mode != "heat" && s.Mode != "windscreen" {
+			return fmt.Errorf("unknown pre-AC mode %q", s.Mode)
+		}
+	case "ignition":
+		if _, ok := ignitionStates[s.Ignition]; !ok {
+			return fmt.Errorf("unknown ignition state %q", s.Ignition)
+		}
+	}
+	return nil
+}
+
+func (s *Step) String() string {
+	if s.Action == "" {
+		return fmt.Sprintf("register %s=%s", s.Register, s.Data)
+	}
+	return s.Action
+}
+
+// RunScenario runs the scenario steps, until complete or the context
+// is cancelled.
+func (c *Car) RunScenario(ctx context.Context, s *Scenario) error {
+	log.Infof("%%PHEV_EMULATOR_SCENARIO%% Running scenario %q", s.Name)
+	for {
+		for i := range s.Steps {
+			step := &s.Steps[i]
+			if err := sleep(ctx, step.After); err != nil {
+				return err
+			}
+			log.Infof("%%PHEV_EMULATOR_SCENARIO%% Step %d: %s", i+1, step)
+			if err := c.runStep(ctx, step); err != nil {
+				// Clients may not be connected, so carry on.
+				log.Errorf("%%PHEV_EMULATOR_SCENARIO%% Step %d: %v", i+1, err)
+			}
+		}
+		if !s.Loop {
+			log.Infof("%%PHEV_EMULATOR_SCENARIO%% Scenario %q complete", s.Name)
+			return nil
+		}
+	}
+}
+
+func (c *Car) runStep(ctx context.Context, s *Step) error {
+	if s.Action != "" {
+		return actions[s.Action](c, ctx, s)
+	}
+	register, _ := hex.DecodeString(s.Register)
+	data, _ := hex.DecodeString(s.Data)
+	return c.UpdateRegister(register[0], data)
+}
+
+// Waits for the duration, or returns the context error if cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Decodes the current value of the register into r. Returns an error
+// if the car has no value for it, or the value is malformed, e.g from
+// a replay or a raw register step.
+func (c *Car) register(register byte, r protocol.Register) error {
+	data := c.RegisterData(register)
+	if data == nil {
+		return fmt.Errorf("no value for register 0x%02x", register)
+	}
+	return r.Decode(protocol.NewMessage(protocol.CmdInResp, register, false, data))
+}
+
+func (c *Car) updateRegister(r protocol.Register) error {
+	return c.UpdateRegister(r.Register(), r.Encode().Data)
+}
+
+func (c *Car) setPlug(connected bool) error {
+	return c.updateRegister(&protocol.RegisterChargePlug{Connected: connected})
+}
+
+func (c *Car) setCharging(charging bool, remaining int) error {
+	return c.updateRegister(&protocol.RegisterChargeStatus{Charging: charging, Remaining: remaining})
+}
+
+func (c *Car) setBatteryLevel(level int) error {
+	r := &protocol.RegisterBatteryLevel{}
+	if err := c.register(protocol.BatteryLevelRegister, r); err != nil {
+		return err
+	}
+	r.Level = level
+	return c.updateRegister(r)
+}
+
+// Charges from the start to end level over the step duration, one
+// percent at a time.
+func (c *Car) charge(ctx context.Context, s *Step) error {
+	steps := s.To - s.From
+	interval := s.Duration / time.Duration(steps)
+	remaining := func(level int) int {
+		return int((time.Duration(s.To-level)*interval + time.Minute - 1) / time.Minute)
+	}
+	if err := c.setBatteryLevel(s.From); err != nil {
+		return err
+	}
+	if err := c.setCharging(true, remaining(s.From)); err != nil {
+		return err
+	}
+	for level := s.From + 1; level <= s.To; level++ {
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		if err := c.setBatteryLevel(level); err != nil {
+			return err
+		}
+		if level < s.To {
+			if err := c.setCharging(true, remaining(level)); err != nil {
+				return err
+			}
+		}
+	}
+	return c.setCharging(false, 0)
+}
+
+func (c *Car) setDoor(door string, open bool) error {
+	r := &protocol.RegisterDoorStatus{}
+	if err := c.register(protocol.DoorStatusRegister, r); err != nil {
+		return err
+	}
+	*doors[door](r) = open
+	return c.updateRegister(r)
+}
+
+func (c *Car) setLocked(locked bool) error {
+	r := &protocol.RegisterDoorStatus{}
+	if err := c.register(protocol.DoorStatusRegister, r); err != nil {
+		return err
+	}
+	r.Locked = locked
+	return c.updateRegister(r)
+}
+
+func (c *Car) startPreAC(ctx context.Context, s *Step) error {
+	duration := s.Duration
+	if duration == 0 {
+		duration = 10 * time.Minute
+	}
+	return c.startClimate(s.Mode, duration)
+}
+
+func (c *Car) setPreAC(state protocol.PreACState) error {
+	return c.updateRegister(&protocol.RegisterPreACState{State: state})
+}
+
+func (c *Car) setIgnition(ctx context.Context, s *Step) error {
+	r := &protocol.RegisterACOperStatus{}
+	if err := c.register(protocol.ACOperStatusRegister, r); err != nil {
+		return err
+	}
+	r.Ignition = ignitionStates[s.Ignition]
+	return c.updateRegister(r)
+}
@@ -0,0 +1,142 @@
+package emulator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestParseScenario(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		in      string
+		want    *Scenario
+		wantErr string
+	}{
+		{
+			name: "actions and registers",
+			in: `name: Evening charge
+loop: true
+steps:
+  - action: plug_in
+  - after: 5s
+    action: charge
+    from: 40
+    to: 100
+    duration: 10m
+  - after: 10s
+    register: "1d"
+    data: "50000000"`,
+			want: &Scenario{Name: "Evening charge", Loop: true, Steps: []Step{
+				{Action: "plug_in"},
+				{After: 5 * time.Second, Action: "charge", From: 40, To: 100, Duration: 10 * time.Minute},
+				{After: 10 * time.Second, Register: "1d", Data: "50000000"},
+			}},
+		},
+		{
+			name: "json",
+			in:   `{"name": "doors", "steps": [{"action": "open_door", "door": "boot"}]}`,
+			want: &Scenario{Name: "doors", Steps: []Step{{Action: "open_door", Door: "boot"}}},
+		},
+		{name: "unknown field", in: `{"steps": [{"action": "lock", "colour": "red"}]}`, wantErr: "parsing scenario"},
+		{name: "no action or register", in: `{"steps": [{"after": "1s"}]}`, wantErr: "step 1: one of action or register"},
+		{name: "bad register", in: `{"steps": [{"register": "zz", "data": "00"}]}`, wantErr: "step 1: bad register"},
+		{name: "bad data", in: `{"steps": [{"register": "1d", "data": "0"}]}`, wantErr: "step 1: bad data"},
+		{name: "unknown action", in: `{"steps": [{"action": "lock"}, {"action": "fly"}]}`, wantErr: "step 2: unknown action"},
+		{name: "charge down", in: `{"steps": [{"action": "charge", "from": 50, "to": 40}]}`, wantErr: "charge needs"},
+		{name: "charge over full", in: `{"steps": [{"action": "charge", "from": 50, "to": 101}]}`, wantErr: "charge needs"},
+		{name: "battery level", in: `{"steps": [{"action": "battery", "level": 101}]}`, wantErr: "bad battery level"},
+		{name: "unknown door", in: `{"steps": [{"action": "close_door", "door": "sunroof"}]}`, wantErr: "unknown door"},
+		{name: "pre-AC mode", in: `{"steps": [{"action": "preac_start", "mode": "warm"}]}`, wantErr: "unknown pre-AC mode"},
+		{name: "ignition", in: `{"steps": [{"action": "ignition", "ignition": "start"}]}`, wantErr: "unknown ignition state"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseScenario([]byte(test.in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseScenario() got err=%v want containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseScenario() unexpected error: %v", err)
+			}
+			if got.Name != test.want.Name || got.Loop != test.want.Loop || len(got.Steps) != len(test.want.Steps) {
+				t.Fatalf("ParseScenario() got=%+v want=%+v", got, test.want)
+			}
+			for i := range got.Steps {
+				if got.Steps[i] != test.want.Steps[i] {
+					t.Errorf("step %d got=%+v want=%+v", i+1, got.Steps[i], test.want.Steps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChargeStep(t *testing.T) {
+	c, err := NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := c.Vehicle.Subscribe()
+	defer c.Vehicle.Unsubscribe(sub)
+	s := &Scenario{Steps: []Step{{Action: "charge", From: 40, To: 43, Duration: 30 * time.Millisecond}}}
+	if err := c.RunScenario(context.Background(), s); err != nil {
+		t.Fatalf("RunScenario() unexpected error: %v", err)
+	}
+
+	levels := []int{}
+	charging := []bool{}
+	for len(sub.C) > 0 {
+		change := <-sub.C
+		if l := change.State.Battery.Level; len(levels) == 0 || levels[len(levels)-1] != l {
+			levels = append(levels, l)
+		}
+		if change.Register == protocol.ChargeStatusRegister {
+			charging = append(charging, change.State.Charge.Charging)
+		}
+	}
+	if want := []int{40, 41, 42, 43}; !equalInts(levels, want) {
+		t.Errorf("battery levels got=%v want=%v", levels, want)
+	}
+	// Charging while below the end level, then stopped.
+	if len(charging) != 2 || !charging[0] || charging[1] {
+		t.Errorf("charging got=%v want=[true false]", charging)
+	}
+	if got := c.Vehicle.State().Charge.Remaining; got != 0 {
+		t.Errorf("Charge.Remaining got=%d want=0", got)
+	}
+}
+
+func TestChargeStepCancel(t *testing.T) {
+	c, err := NewCar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s := &Scenario{Steps: []Step{{Action: "charge", From: 40, To: 50, Duration: time.Hour}}}
+	// Step errors are logged, as clients may not be connected.
+	if err := c.RunScenario(ctx, s); err != nil {
+		t.Errorf("RunScenario() unexpected error: %v", err)
+	}
+	st := c.Vehicle.State()
+	if st.Battery.Level != 40 || !st.Charge.Charging || st.Charge.Remaining != 60 {
+		t.Errorf("state got level=%d charging=%v remaining=%d want 40, true, 60", st.Battery.Level, st.Charge.Charging, st.Charge.Remaining)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
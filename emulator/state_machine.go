@@ -9,45 +9,64 @@ import (
 func (s *Connection) manage() {
 	l := s.AddListener()
 	pingCount := 0
+	_, startResp := s.car.startTypes()
 	defer func() {
 		l.Stop()
 		s.RemoveListener(l)
+		if s.settingsSender != nil {
+			// Let the sender finish.
+			go func(c chan *protocol.PhevMessage) {
+				for range c {
+				}
+			}(s.settingsSender.C)
+		}
 	}()
 	for {
 		select {
-		case msg := <-l.C:
+		case <-s.done:
+			return
+		case msg, ok := <-l.C:
+			if !ok {
+				return
+			}
+			if s.injectBadEncoding(msg) {
+				continue
+			}
 			switch msg.Type {
 			case protocol.CmdOutPingReq:
 				// Ping request from client.
 				pingCount++
-				s.Send <- protocol.NewPingResponseMessage(msg.Register)
+				s.send(protocol.NewPingResponseMessage(msg.Register))
 				if s.key.State == protocol.SecurityEmpty && pingCount == 10 {
 					// Establish initial key after 10th ping.
-					s.state = conSecInit
+					s.setState(conSecInit)
 					s.rekey()
+					break
 				}
-			case protocol.CmdOutMy18StartResp:
+				s.injectRekey()
+			case startResp:
 				if msg.Original[2] == 0x0 {
 					s.rekey()
 					break
 				}
 				if s.key.State == protocol.SecurityKeyProposed {
 					s.key.AcceptProposal()
+					s.changeState(conSecInit, conRegisterStart)
 					s.sendNextRegister()
 				}
 				/*
-					if s.state == conSecInit {
-						s.state = conRegisterStart
+					if s.changeState(conSecInit, conRegisterStart) {
 						s.registerIndex = 0
 						s.sendNextRegister()
 					}
 				*/
 			case protocol.CmdOutSend:
-				if msg.Ack == protocol.Ack {
+				// Not acks of updates sent while sending the registers.
+				if msg.Ack == protocol.Ack && msg.Register == s.sentRegister {
 					s.sendNextRegister()
 				}
 				if msg.Ack == protocol.Request {
-					s.handleSetRegister(msg)
+					go s.handleSetRegister(msg)
 				}
 			}
 		}
@@ -55,7 +74,7 @@ func (s *Connection) manage() {
 }
 
 func (s *Connection) getRegister(r byte) protocol.Register {
-	for _, reg := range s.car.Registers {
+	for _, reg := range s.car.registers() {
 		if reg.Register() == r {
 			return reg
 		}
@@ -64,13 +83,26 @@ func (s *Connection) getRegister(r byte) protocol.Register {
 }
 
 func (s *Connection) handleSetRegister(msg *protocol.PhevMessage) {
+	time.Sleep(s.ackDelay())
+	// The car does not ack writes it refuses.
+	if err := s.car.checkCommand(s.clientID(), msg.Register); err != nil {
+		log.Infof("%%PHEV_EMULATOR_REJECT%% Not acking register %02x: %v", msg.Register, err)
+		return
+	}
 	// Ack the message that came in.
-	s.Send <- protocol.NewMessage(protocol.CmdInResp, msg.Register, true, []byte{0x0})
+	s.send(protocol.NewMessage(protocol.CmdInResp, msg.Register, true, []byte{0x0}))
 	switch msg.Register {
 	case 0x05:
-		s.Send <- protocol.NewMessage(protocol.CmdInResp, protocol.TimeRegister, false, msg.Data)
+		s.send(protocol.NewMessage(protocol.CmdInResp, protocol.TimeRegister, false, msg.Data))
 		time.Sleep(20 * time.Millisecond)
-		s.Send <- protocol.NewMessage(protocol.CmdInResp, protocol.BatteryLevelRegister, false, []byte{0x50, 0x00, 0x00, 0x00})
+		s.send(protocol.NewMessage(protocol.CmdInResp, protocol.BatteryLevelRegister, false, []byte{0x50, 0x00, 0x00, 0x00}))
+	default:
+		// Updates are sent to all clients, which waits for their acks.
+		go func() {
+			if err := s.car.handleCommand(s.clientID(), msg.Register, msg.Data); err != nil {
+				log.Errorf("%%PHEV_SVC_COMMAND_ERROR%% register %02x: %v", msg.Register, err)
+			}
+		}()
 	}
 
 }
@@ -78,7 +110,8 @@ func (s *Connection) handleSetRegister(msg *protocol.PhevMessage) {
 func (s *Connection) sendNextRegister() {
 	if s.settingsSender != nil {
 		if setting, ok := <-s.settingsSender.C; ok {
-			s.Send <- setting
+			s.sentRegister = setting.Register
+			s.send(setting)
 		} else {
 			s.settingsSender = nil
 		}
@@ -87,14 +120,17 @@ func (s *Connection) sendNextRegister() {
 	if s.registerIndex < 0 {
 		return
 	}
-	msg := s.car.Registers[s.registerIndex].Encode()
+	registers := s.car.registers()
+	msg := registers[s.registerIndex].Encode()
 	msg.Type = protocol.CmdInResp
 	msg.Ack = protocol.Request
-	s.Send <- msg
+	s.sentRegister = msg.Register
+	s.send(msg)
 
 	s.registerIndex++
-	if s.registerIndex >= len(s.car.Registers) {
+	if s.registerIndex >= len(registers) {
 		s.registerIndex = -1
+		s.setState(conEstablished)
 		log.Debug("Finished sending registers, sending settings")
 		s.settingsSender = s.car.Settings.NewSender()
 		s.settingsSender.Start()
@@ -103,10 +139,11 @@ func (s *Connection) sendNextRegister() {
 
 // Generate and send new key request.
 func (s *Connection) rekey() {
-	if s.state == conRegisterStart {
-		s.Send <- protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, true, []byte{0x0})
+	startReq, _ := s.car.startTypes()
+	if s.getState() == conRegisterStart {
+		s.send(protocol.NewMessage(startReq, 0x1, true, []byte{0x0}))
 	}
 	data := s.key.GenerateProposal()
-	s.Send <- protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, false, append(data, 0x1))
+	s.send(protocol.NewMessage(startReq, 0x1, false, append(data, 0x1)))
 	s.key.State = protocol.SecurityKeyProposed
 }
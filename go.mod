@@ -11,8 +11,10 @@ require (
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
-	github.com/wercker/journalhook v0.0.0-20230927020745-64542ffa4117 // indirect
+	github.com/wercker/journalhook v0.0.0-20230927020745-64542ffa4117
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/exp v0.0.0-20200224162631-6cc2880d07d6 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	gopkg.in/d4l3k/messagediff.v1 v1.2.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,214 @@
+// Package history stores a time series of register changes from
+// a Phev in a local database.
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Every register change, keyed by time then register.
+	changesBucket = []byte("changes")
+	// The latest value of each register, keyed by register.
+	latestBucket = []byte("latest")
+	// Details of the car, keyed by name.
+	carBucket = []byte("car")
+
+	modelYearKey = []byte("model_year")
+)
+
+// An Entry is a register value at a point in time.
+type Entry struct {
+	Time     time.Time
+	Register byte
+	Data     []byte
+	// ModelYear is the car's model year, which the data is in the
+	// format of.
+	ModelYear protocol.ModelYear
+}
+
+// Store is a history database. It is kept open, and locked, until
+// closed.
+type Store struct {
+	db *bolt.DB
+	// Guards the values last stored, to only store changes.
+	mu        sync.Mutex
+	latest    map[byte][]byte
+	modelYear protocol.ModelYear
+}
+
+// Open opens or creates the database at path.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening history %s: %v", path, err)
+	}
+	s := &Store{db: db, latest: map[byte][]byte{}}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{changesBucket, latestBucket, carBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		s.modelYear = modelYear(tx)
+		return tx.Bucket(latestBucket).ForEach(func(k, v []byte) error {
+			s.latest[k[0]] = append([]byte{}, v[8:]...)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenReadOnly opens the existing database at path for queries. It
+// fails if the database is open for recording, e.g by a running
+// gateway.
+func OpenReadOnly(path string) (*Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("opening history %s: in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening history %s: %v", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Returns the stored model year, unknown if not stored. Databases
+// from before it was stored have no car bucket.
+func modelYear(tx *bolt.Tx) protocol.ModelYear {
+	b := tx.Bucket(carBucket)
+	if b == nil {
+		return protocol.ModelYearUnknown
+	}
+	if v := b.Get(modelYearKey); len(v) == 1 {
+		return protocol.ModelYear(v[0])
+	}
+	return protocol.ModelYearUnknown
+}
+
+// SetModelYear stores the car's model year, which entries are then
+// decoded as.
+func (s *Store) SetModelYear(year protocol.ModelYear) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if year == s.modelYear || year == protocol.ModelYearUnknown {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(carBucket).Put(modelYearKey, []byte{byte(year)})
+	})
+	if err != nil {
+		return err
+	}
+	s.modelYear = year
+	return nil
+}
+
+// Keys sort by time, so ranges can be scanned in order.
+func changeKey(t time.Time, register byte) []byte {
+	key := make([]byte, 9)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	key[8] = register
+	return key
+}
+
+func decodeChange(k, v []byte) Entry {
+	return Entry{
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(k))),
+		Register: k[8],
+		Data:     append([]byte{}, v...),
+	}
+}
+
+// Latest values are the time followed by the data.
+func decodeLatest(k, v []byte) Entry {
+	return Entry{
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+		Register: k[0],
+		Data:     append([]byte{}, v[8:]...),
+	}
+}
+
+// Record stores the register value, if it changed from the latest
+// stored value. Returns true if it was stored. Unchanged values are
+// not written, as the car resends them every few seconds.
+func (s *Store) Record(t time.Time, register byte, data []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.latest[register]; ok && bytes.Equal(v, data) {
+		return false, nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(changesBucket).Put(changeKey(t, register), data); err != nil {
+			return err
+		}
+		v := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+		return tx.Bucket(latestBucket).Put([]byte{register}, append(v, data...))
+	})
+	if err != nil {
+		return false, err
+	}
+	s.latest[register] = append([]byte{}, data...)
+	return true, nil
+}
+
+// Latest returns the latest value of every register, ordered by register.
+func (s *Store) Latest() ([]Entry, error) {
+	entries := []Entry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		year := modelYear(tx)
+		return tx.Bucket(latestBucket).ForEach(func(k, v []byte) error {
+			e := decodeLatest(k, v)
+			e.ModelYear = year
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Query returns the changes from the start time until before the end
+// time, in time order. If registers are given, only those are returned.
+func (s *Store) Query(from, to time.Time, registers ...byte) ([]Entry, error) {
+	want := map[byte]bool{}
+	for _, r := range registers {
+		want[r] = true
+	}
+	entries := []Entry{}
+	end := changeKey(to, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		year := modelYear(tx)
+		c := tx.Bucket(changesBucket).Cursor()
+		for k, v := c.Seek(changeKey(from, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			if len(want) > 0 && !want[k[8]] {
+				continue
+			}
+			e := decodeChange(k, v)
+			e.ModelYear = year
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
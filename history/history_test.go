@@ -0,0 +1,318 @@
+package history
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestStore(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []struct {
+		offset   time.Duration
+		register byte
+		data     string
+		want     bool
+	}{
+		{0, protocol.BatteryLevelRegister, "32000000", true},
+		{time.Minute, protocol.BatteryLevelRegister, "32000000", false},
+		{2 * time.Minute, protocol.ChargeStatusRegister, "011e00", true},
+		{3 * time.Minute, protocol.BatteryLevelRegister, "3c000000", true},
+		{4 * time.Minute, protocol.ChargeStatusRegister, "000000", true},
+	}
+	for _, r := range records {
+		data, _ := hex.DecodeString(r.data)
+		got, err := s.Record(start.Add(r.offset), r.register, data)
+		if err != nil {
+			t.Fatalf("Record() unexpected error: %v", err)
+		}
+		if got != r.want {
+			t.Errorf("Record(%v, %02x, %s) got=%v want=%v", r.offset, r.register, r.data, got, r.want)
+		}
+	}
+
+	latest, err := s.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || hex.EncodeToString(latest[0].Data) != "3c000000" || !latest[0].Time.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Latest() got=%v", latest)
+	}
+
+	entries, err := s.Query(start.Add(time.Minute), start.Add(4*time.Minute), protocol.BatteryLevelRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].Time.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Query() got=%v", entries)
+	}
+
+	all, err := s.Query(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the plug state, sessions end when charging stops.
+	sessions := ChargeSessions(all, 12)
+	if len(sessions) != 1 {
+		t.Fatalf("ChargeSessions() got=%v", sessions)
+	}
+	want := ChargeSession{Start: start.Add(2 * time.Minute), End: start.Add(4 * time.Minute), StartLevel: 50, EndLevel: 60, Energy: 1.2}
+	if got := sessions[0]; !sessionEqual(got, want) {
+		t.Errorf("ChargeSessions() got=%+v want=%+v", got, want)
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []struct {
+		offset   time.Duration
+		register byte
+		data     string
+	}{
+		{0, protocol.BatteryLevelRegister, "14000000"},
+		{time.Minute, protocol.ChargePlugRegister, "0101"},
+		{2 * time.Minute, protocol.ChargeStatusRegister, "017800"},
+		{time.Hour, protocol.BatteryLevelRegister, "3c000000"},
+		{2 * time.Hour, protocol.ChargeStatusRegister, "000000"},
+		{3 * time.Hour, protocol.BatteryLevelRegister, "64000000"},
+		{3 * time.Hour, protocol.ChargeStatusRegister, "010a00"},
+		{4 * time.Hour, protocol.ChargeStatusRegister, "000000"},
+	}
+	tracker := NewSessionTracker(10)
+	for _, e := range entries {
+		data, _ := hex.DecodeString(e.data)
+		if s := tracker.Update(Entry{Time: start.Add(e.offset), Register: e.register, Data: data}); s != nil {
+			t.Fatalf("Update() completed early: %+v", s)
+		}
+	}
+	s := tracker.Update(Entry{Time: start.Add(5 * time.Hour), Register: protocol.ChargePlugRegister, Data: []byte{0x0, 0x0}})
+	want := &ChargeSession{
+		PluggedIn:  start.Add(time.Minute),
+		Unplugged:  start.Add(5 * time.Hour),
+		Start:      start.Add(2 * time.Minute),
+		End:        start.Add(4 * time.Hour),
+		StartLevel: 20,
+		EndLevel:   100,
+		Energy:     8,
+	}
+	if s == nil || !sessionEqual(*s, *want) {
+		t.Errorf("Update() got=%+v want=%+v", s, want)
+	}
+	if s := tracker.Current(); s != nil {
+		t.Errorf("Current() got=%+v want=nil", s)
+	}
+}
+
+func TestSessionTrackerRestore(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now().Add(-10 * time.Hour).Truncate(time.Second)
+	records := []struct {
+		offset   time.Duration
+		register byte
+		data     string
+	}{
+		// Before the restore period.
+		{-time.Hour, protocol.ChargePlugRegister, "0101"},
+		// A completed session.
+		{0, protocol.BatteryLevelRegister, "14000000"},
+		{time.Minute, protocol.ChargeStatusRegister, "017800"},
+		{time.Hour, protocol.ChargeStatusRegister, "000000"},
+		{2 * time.Hour, protocol.ChargePlugRegister, "0000"},
+		// The session in progress.
+		{3 * time.Hour, protocol.BatteryLevelRegister, "1e000000"},
+		{4 * time.Hour, protocol.ChargePlugRegister, "0101"},
+		{5 * time.Hour, protocol.ChargeStatusRegister, "017800"},
+		{6 * time.Hour, protocol.BatteryLevelRegister, "28000000"},
+	}
+	for _, r := range records {
+		data, _ := hex.DecodeString(r.data)
+		if _, err := s.Record(start.Add(r.offset), r.register, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := NewSessionTracker(10)
+	if err := tracker.Restore(s, start); err != nil {
+		t.Fatalf("Restore() unexpected error: %v", err)
+	}
+	want := &ChargeSession{
+		PluggedIn:  start.Add(4 * time.Hour),
+		Start:      start.Add(5 * time.Hour),
+		StartLevel: 30,
+		EndLevel:   40,
+		Energy:     1,
+	}
+	if got := tracker.Current(); got == nil || !sessionEqual(*got, *want) {
+		t.Errorf("Current() got=%+v want=%+v", got, want)
+	}
+	got := tracker.Update(Entry{Time: start.Add(7 * time.Hour), Register: protocol.ChargePlugRegister, Data: []byte{0x0, 0x0}})
+	want.Unplugged = start.Add(7 * time.Hour)
+	want.End = want.Unplugged
+	if got == nil || !sessionEqual(*got, *want) {
+		t.Errorf("Update() got=%+v want=%+v", got, want)
+	}
+}
+
+func TestTrips(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []struct {
+		offset   time.Duration
+		register byte
+		data     string
+	}{
+		{0, protocol.BatteryLevelRegister, "50000000"},
+		{0, protocol.ACOperStatusRegister, "0000000000"},
+		{0, protocol.DoorStatusRegister, "01000000000000000000"},
+		// Seen driving away.
+		{time.Hour, protocol.DoorStatusRegister, "00000000000000000000"},
+		{time.Hour + time.Minute, protocol.ACOperStatusRegister, "0400000000"},
+		{2 * time.Hour, protocol.BatteryLevelRegister, "46000000"},
+		{2 * time.Hour, protocol.ACOperStatusRegister, "0000000000"},
+		{2*time.Hour + time.Minute, protocol.DoorStatusRegister, "01000000000000000000"},
+		// Driven out of range, back with a lower level.
+		{3 * time.Hour, protocol.DoorStatusRegister, "00000000000000000000"},
+		{5 * time.Hour, protocol.BatteryLevelRegister, "3c000000"},
+		// Charging does not end a trip.
+		{6 * time.Hour, protocol.ChargeStatusRegister, "011e00"},
+		{7 * time.Hour, protocol.BatteryLevelRegister, "46000000"},
+		{8 * time.Hour, protocol.ChargeStatusRegister, "000000"},
+		{9 * time.Hour, protocol.ACOperStatusRegister, "0400000000"},
+	}
+	all := []Entry{}
+	for _, e := range entries {
+		data, _ := hex.DecodeString(e.data)
+		all = append(all, Entry{Time: start.Add(e.offset), Register: e.register, Data: data})
+	}
+	want := []Trip{
+		{Start: start.Add(time.Hour + time.Minute), End: start.Add(2 * time.Hour), StartLevel: 80, EndLevel: 70},
+		{Start: start.Add(3 * time.Hour), End: start.Add(5 * time.Hour), StartLevel: 70, EndLevel: 60, Inferred: true},
+		{Start: start.Add(9 * time.Hour), StartLevel: 70, EndLevel: 70},
+	}
+	got := Trips(all)
+	if len(got) != len(want) {
+		t.Fatalf("Trips() got=%+v want=%+v", got, want)
+	}
+	for i := range want {
+		if !tripEqual(got[i], want[i]) {
+			t.Errorf("Trips()[%d] got=%+v want=%+v", i, got[i], want[i])
+		}
+	}
+
+	d := NewTripDetector()
+	for _, e := range all[:8] {
+		d.Update(e)
+	}
+	if got, want := d.ParkedSince(), start.Add(2*time.Hour); !got.Equal(want) {
+		t.Errorf("ParkedSince() got=%v want=%v", got, want)
+	}
+}
+
+func TestTripsPreconditioning(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []struct {
+		offset   time.Duration
+		register byte
+		data     string
+	}{
+		{0, protocol.BatteryLevelRegister, "50000000"},
+		{0, protocol.ACOperStatusRegister, "0000000000"},
+		{0, protocol.DoorStatusRegister, "01000000000000000000"},
+		// Warming the car before departure.
+		{time.Hour, protocol.PreACStateRegister, "020000"},
+		{time.Hour, protocol.ACOperStatusRegister, "0001000000"},
+		{time.Hour + 10*time.Minute, protocol.BatteryLevelRegister, "4b000000"},
+		{time.Hour + 20*time.Minute, protocol.BatteryLevelRegister, "48000000"},
+		{time.Hour + 30*time.Minute, protocol.PreACStateRegister, "010000"},
+		{time.Hour + 30*time.Minute, protocol.ACOperStatusRegister, "0000000000"},
+		{time.Hour + 31*time.Minute, protocol.BatteryLevelRegister, "48000000"},
+		// Then driven out of range.
+		{3 * time.Hour, protocol.BatteryLevelRegister, "3c000000"},
+	}
+	all := []Entry{}
+	for _, e := range entries {
+		data, _ := hex.DecodeString(e.data)
+		all = append(all, Entry{Time: start.Add(e.offset), Register: e.register, Data: data})
+	}
+	want := []Trip{
+		{Start: start, End: start.Add(3 * time.Hour), StartLevel: 72, EndLevel: 60, Inferred: true},
+	}
+	got := Trips(all)
+	if len(got) != len(want) {
+		t.Fatalf("Trips() got=%+v want=%+v", got, want)
+	}
+	if !tripEqual(got[0], want[0]) {
+		t.Errorf("Trips()[0] got=%+v want=%+v", got[0], want[0])
+	}
+}
+
+func tripEqual(a, b Trip) bool {
+	return a.Start.Equal(b.Start) && a.End.Equal(b.End) &&
+		a.StartLevel == b.StartLevel && a.EndLevel == b.EndLevel && a.Inferred == b.Inferred
+}
+
+func sessionEqual(a, b ChargeSession) bool {
+	return a.PluggedIn.Equal(b.PluggedIn) && a.Unplugged.Equal(b.Unplugged) &&
+		a.Start.Equal(b.Start) && a.End.Equal(b.End) &&
+		a.StartLevel == b.StartLevel && a.EndLevel == b.EndLevel && a.Energy == b.Energy
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Errorf("OpenReadOnly() of missing database got=nil want error")
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := s.Record(now, protocol.BatteryLevelRegister, []byte{0x32, 0x0, 0x0, 0x0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetModelYear(protocol.ModelYear14); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Errorf("OpenReadOnly() while recording got=nil want error")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() unexpected error: %v", err)
+	}
+	got, err := r.Query(now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Query() unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].ModelYear != protocol.ModelYear14 {
+		t.Errorf("Query() got=%+v want 1 MY14 entry", got)
+	}
+	r.Close()
+
+	// The latest values are not stored again after reopening.
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if stored, err := s.Record(now.Add(time.Second), protocol.BatteryLevelRegister, []byte{0x32, 0x0, 0x0, 0x0}); err != nil || stored {
+		t.Errorf("Record() of unchanged value after reopening got=(%v, %v) want=(false, nil)", stored, err)
+	}
+}
@@ -0,0 +1,184 @@
+package history
+
+import (
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// A ChargeSession is a period when the car was plugged in to charge.
+// Times are zero if not known, or not yet happened.
+type ChargeSession struct {
+	PluggedIn time.Time `json:"plugged_in"`
+	Unplugged time.Time `json:"unplugged"`
+	// Start and End are when charging started and last stopped.
+	Start time.Time `json:"charge_start"`
+	End   time.Time `json:"charge_end"`
+	// Battery levels in percent at the start and end, 0 if unknown.
+	StartLevel int `json:"start_level"`
+	EndLevel   int `json:"end_level"`
+	// Energy is the estimated energy charged, in kWh.
+	Energy float64 `json:"energy_kwh"`
+}
+
+// Duration returns how long the car was charging, up to now if
+// still charging.
+func (s *ChargeSession) Duration() time.Duration {
+	switch {
+	case s.Start.IsZero():
+		return 0
+	case s.End.IsZero():
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+// SessionTracker groups register updates into charge sessions. A
+// session runs from plug in to plug out, or from the start to end
+// of charging if the plug state is not known.
+type SessionTracker struct {
+	// Capacity is the usable battery capacity in kWh, used to
+	// estimate the energy charged.
+	Capacity float64
+
+	current   *ChargeSession
+	level     int
+	plugKnown bool
+	charging  bool
+}
+
+// NewSessionTracker returns a tracker for a battery of the given
+// capacity in kWh.
+func NewSessionTracker(capacity float64) *SessionTracker {
+	return &SessionTracker{Capacity: capacity}
+}
+
+// Current returns the session in progress, or nil.
+func (t *SessionTracker) Current() *ChargeSession {
+	if t.current == nil {
+		return nil
+	}
+	s := *t.current
+	return &s
+}
+
+// Update updates the tracker with a register value, returning the
+// session if it completed.
+func (t *SessionTracker) Update(e Entry) *ChargeSession {
+	switch reg := protocol.NewRegisterMessage(e.Register, e.ModelYear, e.Data).Reg.(type) {
+	case *protocol.RegisterBatteryLevel:
+		if reg.Level <= 5 || reg.Level >= 255 {
+			return nil
+		}
+		t.level = reg.Level
+		if t.current != nil {
+			if t.current.StartLevel == 0 {
+				t.current.StartLevel = t.level
+			}
+			t.current.EndLevel = t.level
+			t.estimate(t.current)
+		}
+	case *protocol.RegisterChargePlug:
+		t.plugKnown = true
+		switch {
+		case reg.Connected && t.current == nil:
+			t.current = &ChargeSession{PluggedIn: e.Time}
+		case !reg.Connected && t.current != nil:
+			t.current.Unplugged = e.Time
+			if t.charging {
+				t.current.End = e.Time
+				t.charging = false
+			}
+			return t.complete()
+		}
+	case *protocol.RegisterChargeStatus:
+		switch {
+		case reg.Charging && !t.charging:
+			t.charging = true
+			if t.current == nil {
+				t.current = &ChargeSession{}
+			}
+			if t.current.Start.IsZero() {
+				t.current.Start = e.Time
+				t.current.StartLevel = t.level
+				t.current.EndLevel = t.level
+			}
+			t.current.End = time.Time{}
+		case !reg.Charging && t.charging:
+			t.charging = false
+			if t.current == nil {
+				return nil
+			}
+			t.current.End = e.Time
+			if !t.plugKnown {
+				return t.complete()
+			}
+		}
+	}
+	return nil
+}
+
+// Restore replays the charge changes stored since the given time, so
+// a session in progress continues across restarts. Sessions that
+// completed in that time are dropped.
+func (t *SessionTracker) Restore(s *Store, since time.Time) error {
+	entries, err := s.Query(since, time.Now(), protocol.BatteryLevelRegister, protocol.ChargePlugRegister, protocol.ChargeStatusRegister)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		t.Update(e)
+	}
+	return nil
+}
+
+// Estimates the energy charged from the battery levels.
+func (t *SessionTracker) estimate(s *ChargeSession) {
+	s.Energy = 0
+	if s.StartLevel > 0 && s.EndLevel > s.StartLevel {
+		s.Energy = float64(s.EndLevel-s.StartLevel) * t.Capacity / 100
+	}
+}
+
+func (t *SessionTracker) complete() *ChargeSession {
+	s := t.current
+	t.current = nil
+	return s
+}
+
+// BatteryLevel is a battery level reading.
+type BatteryLevel struct {
+	Time  time.Time
+	Level int
+}
+
+// BatteryLevels returns the battery levels in the entries, skipping
+// bogus readings.
+func BatteryLevels(entries []Entry) []BatteryLevel {
+	levels := []BatteryLevel{}
+	for _, e := range entries {
+		reg, ok := protocol.NewRegisterMessage(e.Register, e.ModelYear, e.Data).Reg.(*protocol.RegisterBatteryLevel)
+		if !ok || reg.Level <= 5 || reg.Level >= 255 {
+			continue
+		}
+		levels = append(levels, BatteryLevel{Time: e.Time, Level: reg.Level})
+	}
+	return levels
+}
+
+// ChargeSessions returns the charge sessions in the entries, which
+// are in time order and include the charge status, charge plug and
+// battery level registers. The last session may be in progress.
+func ChargeSessions(entries []Entry, capacity float64) []ChargeSession {
+	sessions := []ChargeSession{}
+	t := NewSessionTracker(capacity)
+	for _, e := range entries {
+		if s := t.Update(e); s != nil {
+			sessions = append(sessions, *s)
+		}
+	}
+	if s := t.Current(); s != nil {
+		sessions = append(sessions, *s)
+	}
+	return sessions
+}
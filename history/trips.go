@@ -0,0 +1,160 @@
+package history
+
+import (
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// A battery level drop of at least this many percent while parked
+// means the car was driven out of wifi range.
+const tripLevelDrop = 3
+
+// A Trip is a period when the car was driven.
+type Trip struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Battery levels in percent at the start and end, 0 if unknown.
+	StartLevel int `json:"start_level"`
+	EndLevel   int `json:"end_level"`
+	// Inferred is true if the ignition was not seen on, and the trip
+	// was inferred from the battery level dropping while parked. The
+	// start is then when the car was unlocked, if known.
+	Inferred bool `json:"inferred"`
+}
+
+// Duration returns how long the trip took, up to now if still driving.
+func (t *Trip) Duration() time.Duration {
+	if t.End.IsZero() {
+		return time.Since(t.Start)
+	}
+	return t.End.Sub(t.Start)
+}
+
+// TripDetector derives trips from the ignition, door lock and
+// battery level registers. A trip runs from the ignition turning on
+// until it turns off.
+//
+// The car is usually out of wifi range while driven, so the ignition
+// may not be seen turning on. A trip is then inferred when the car
+// comes back with a lower battery level, and was not charging. Levels
+// while the climate control runs are not compared, as pre-conditioning
+// drains the battery while parked.
+type TripDetector struct {
+	current     *Trip
+	parkedSince time.Time
+	// Battery level when parked, to detect unseen trips.
+	parkedLevel int
+	level       int
+	charging    bool
+	climate     bool
+	preAC       bool
+	doorsKnown  bool
+	locked      bool
+	unlocked    time.Time
+}
+
+// NewTripDetector returns a detector with no known trips.
+func NewTripDetector() *TripDetector {
+	return &TripDetector{}
+}
+
+// Current returns the trip in progress, or nil.
+func (d *TripDetector) Current() *Trip {
+	if d.current == nil {
+		return nil
+	}
+	t := *d.current
+	return &t
+}
+
+// ParkedSince returns when the car was parked, zero if being
+// driven or not yet known.
+func (d *TripDetector) ParkedSince() time.Time {
+	return d.parkedSince
+}
+
+// Update updates the detector with a register value, returning the
+// trip if it completed.
+func (d *TripDetector) Update(e Entry) *Trip {
+	switch reg := protocol.NewRegisterMessage(e.Register, e.ModelYear, e.Data).Reg.(type) {
+	case *protocol.RegisterBatteryLevel:
+		if reg.Level <= 5 || reg.Level >= 255 {
+			return nil
+		}
+		d.level = reg.Level
+		switch {
+		case d.current != nil:
+			if d.current.StartLevel == 0 {
+				d.current.StartLevel = d.level
+			}
+			d.current.EndLevel = d.level
+		case d.parkedSince.IsZero():
+		case d.climate || d.preAC:
+			d.parkedLevel = d.level
+		case d.parkedLevel-d.level >= tripLevelDrop && !d.charging:
+			start := d.parkedSince
+			if d.unlocked.After(start) {
+				start = d.unlocked
+			}
+			return d.complete(&Trip{
+				Start:      start,
+				End:        e.Time,
+				StartLevel: d.parkedLevel,
+				EndLevel:   d.level,
+				Inferred:   true,
+			})
+		case d.level > d.parkedLevel:
+			d.parkedLevel = d.level
+		}
+	case *protocol.RegisterChargeStatus:
+		d.charging = reg.Charging
+	case *protocol.RegisterDoorStatus:
+		if !reg.Locked && (d.locked || !d.doorsKnown) {
+			d.unlocked = e.Time
+		}
+		d.doorsKnown = true
+		d.locked = reg.Locked
+	case *protocol.RegisterPreACState:
+		d.preAC = reg.State == protocol.PreACOn
+	case *protocol.RegisterACOperStatus:
+		d.climate = reg.Operating
+		on := reg.Ignition == protocol.IgnitionOn
+		switch {
+		case on && d.current == nil:
+			d.current = &Trip{Start: e.Time, StartLevel: d.level, EndLevel: d.level}
+			d.parkedSince = time.Time{}
+		case !on && d.current != nil:
+			d.current.End = e.Time
+			return d.complete(d.current)
+		case !on && d.parkedSince.IsZero():
+			d.parkedSince = e.Time
+			d.parkedLevel = d.level
+		}
+	}
+	return nil
+}
+
+func (d *TripDetector) complete(t *Trip) *Trip {
+	d.current = nil
+	d.parkedSince = t.End
+	d.parkedLevel = t.EndLevel
+	return t
+}
+
+// Trips returns the trips in the entries, which are in time order and
+// include the ignition, pre-AC, door, charge status and battery level
+// registers. The last trip may be in progress.
+func Trips(entries []Entry) []Trip {
+	trips := []Trip{}
+	d := NewTripDetector()
+	for _, e := range entries {
+		if t := d.Update(e); t != nil {
+			trips = append(trips, *t)
+		}
+	}
+	if t := d.Current(); t != nil {
+		trips = append(trips, *t)
+	}
+	return trips
+}
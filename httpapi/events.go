@@ -0,0 +1,116 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often to send a keepalive comment on idle event streams.
+var keepaliveInterval = 30 * time.Second
+
+// eventFilter selects which messages are streamed.
+type eventFilter struct {
+	// registers to send, all if empty.
+	registers map[byte]bool
+	pings     bool
+	acks      bool
+}
+
+// Parses the filter from the query, e.g "?register=1d,24&pings=true".
+func parseEventFilter(r *http.Request) (*eventFilter, error) {
+	q := r.URL.Query()
+	f := &eventFilter{registers: map[byte]bool{}}
+	for _, regs := range q["register"] {
+		for _, reg := range strings.Split(regs, ",") {
+			v, err := strconv.ParseUint(strings.TrimSpace(reg), 16, 8)
+			if err != nil {
+				return nil, badRequest("bad register %q", reg)
+			}
+			f.registers[byte(v)] = true
+		}
+	}
+	var err error
+	if s := q.Get("pings"); s != "" {
+		if f.pings, err = strconv.ParseBool(s); err != nil {
+			return nil, badRequest("bad pings %q", s)
+		}
+	}
+	if s := q.Get("acks"); s != "" {
+		if f.acks, err = strconv.ParseBool(s); err != nil {
+			return nil, badRequest("bad acks %q", s)
+		}
+	}
+	return f, nil
+}
+
+func (f *eventFilter) match(msg *protocol.PhevMessage) bool {
+	switch {
+	case msg.Type == protocol.CmdInPingResp:
+		return f.pings && len(f.registers) == 0
+	case msg.Type != protocol.CmdInResp:
+		return len(f.registers) == 0
+	case msg.Ack == protocol.Ack && !f.acks:
+		return false
+	}
+	return len(f.registers) == 0 || f.registers[msg.Register]
+}
+
+// Handles /events, streaming messages from the car as server-sent
+// events, one JSON encoded message per event.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)})
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, &httpError{http.StatusInternalServerError, fmt.Errorf("streaming not supported")})
+		return
+	}
+
+	l := s.client.AddListener()
+	defer s.client.RemoveListener(l)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case msg, ok := <-l.C:
+			if !ok {
+				return
+			}
+			if !filter.match(msg) {
+				continue
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Debugf("%%PHEV_HTTP_EVENT_ERROR%%: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func TestParseEventFilter(t *testing.T) {
+	for _, test := range []struct {
+		query     string
+		registers []byte
+		pings     bool
+		acks      bool
+		wantErr   bool
+	}{
+		{query: ""},
+		{query: "register=1d,24&register=10", registers: []byte{0x1d, 0x24, 0x10}},
+		{query: "register=%201D%20", registers: []byte{0x1d}},
+		{query: "pings=true&acks=1", pings: true, acks: true},
+		{query: "register=zz", wantErr: true},
+		{query: "register=100", wantErr: true},
+		{query: "register=1d,", wantErr: true},
+		{query: "pings=maybe", wantErr: true},
+		{query: "acks=2", wantErr: true},
+	} {
+		f, err := parseEventFilter(httptest.NewRequest("GET", "/events?"+test.query, nil))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseEventFilter(%q) want error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEventFilter(%q) unexpected error: %v", test.query, err)
+			continue
+		}
+		if f.pings != test.pings || f.acks != test.acks || len(f.registers) != len(test.registers) {
+			t.Errorf("parseEventFilter(%q) got=%+v", test.query, f)
+			continue
+		}
+		for _, reg := range test.registers {
+			if !f.registers[reg] {
+				t.Errorf("parseEventFilter(%q) got registers=%v want %02x", test.query, f.registers, reg)
+			}
+		}
+	}
+}
+
+func TestEventFilterMatch(t *testing.T) {
+	battery := protocol.NewMessage(protocol.CmdInResp, protocol.BatteryLevelRegister, false, []byte{0x50, 0x0, 0x0, 0x0})
+	batteryAck := protocol.NewMessage(protocol.CmdInResp, protocol.BatteryLevelRegister, true, []byte{0x0})
+	doors := protocol.NewMessage(protocol.CmdInResp, protocol.DoorStatusRegister, false, make([]byte, 10))
+	ping := protocol.NewMessage(protocol.CmdInPingResp, 0xa, false, []byte{0x0})
+	start := protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, false, make([]byte, 9))
+
+	all := &eventFilter{registers: map[byte]bool{}}
+	pings := &eventFilter{registers: map[byte]bool{}, pings: true}
+	acks := &eventFilter{registers: map[byte]bool{}, acks: true}
+	onlyBattery := &eventFilter{registers: map[byte]bool{protocol.BatteryLevelRegister: true}, pings: true, acks: true}
+	for _, test := range []struct {
+		name   string
+		filter *eventFilter
+		msg    *protocol.PhevMessage
+		want   bool
+	}{
+		{"register", all, battery, true},
+		{"other message", all, start, true},
+		{"ping", all, ping, false},
+		{"ping with pings", pings, ping, true},
+		{"ack", all, batteryAck, false},
+		{"ack with acks", acks, batteryAck, true},
+		{"filtered register", onlyBattery, battery, true},
+		{"filtered register ack", onlyBattery, batteryAck, true},
+		{"other register", onlyBattery, doors, false},
+		{"other message with registers", onlyBattery, start, false},
+		{"ping with registers", onlyBattery, ping, false},
+	} {
+		if got := test.filter.match(test.msg); got != test.want {
+			t.Errorf("%s: match() got=%v want=%v", test.name, got, test.want)
+		}
+	}
+}
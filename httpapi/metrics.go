@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// metrics writes metrics in the Prometheus text format.
+type metrics struct {
+	bytes.Buffer
+}
+
+func (m *metrics) header(name, typ, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// metric writes a metric with no labels.
+func (m *metrics) metric(name, typ, help string, value float64) {
+	m.header(name, typ, help)
+	fmt.Fprintf(m, "%s %g\n", name, value)
+}
+
+// stateMetric writes one series per state, set to 1 for the current state.
+func (m *metrics) stateMetric(name, help string, current string, states ...string) {
+	m.header(name, "gauge", help)
+	for _, s := range states {
+		fmt.Fprintf(m, "%s{state=%q} %g\n", name, s, boolValue(current == s))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handles /metrics. Vehicle metrics are only present once the
+// register has been received from the car.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m := &metrics{}
+
+	if reg, ok := s.client.LastRegister(protocol.BatteryLevelRegister).(*protocol.RegisterBatteryLevel); ok {
+		// The car sometimes reports bogus levels, which would spoil graphs.
+		if reg.Level > 5 && reg.Level < 255 {
+			m.metric("phev_battery_level_percent", "gauge", "Drive battery level.", float64(reg.Level))
+		}
+	}
+	if reg, ok := s.client.LastRegister(protocol.ChargeStatusRegister).(*protocol.RegisterChargeStatus); ok {
+		m.metric("phev_charging", "gauge", "Whether the battery is charging.", boolValue(reg.Charging))
+		if reg.Remaining < 1000 {
+			m.metric("phev_charge_remaining_minutes", "gauge", "Charging time remaining.", float64(reg.Remaining))
+		}
+	}
+	if reg, ok := s.client.LastRegister(protocol.ChargePlugRegister).(*protocol.RegisterChargePlug); ok {
+		m.metric("phev_charge_plug_connected", "gauge", "Whether the charge plug is connected.", boolValue(reg.Connected))
+	}
+	if reg, ok := s.client.LastRegister(protocol.PreACStateRegister).(*protocol.RegisterPreACState); ok {
+		m.stateMetric("phev_climate_state", "Climate control state.", reg.State.String(),
+			protocol.PreACOff.String(), protocol.PreACOn.String(), protocol.PreACTerminated.String())
+	}
+
+	m.stateMetric("phev_connection_state", "Connection state to the car.", s.client.State().String(),
+		client.StateDisconnected.String(), client.StateConnecting.String(), client.StateSecuring.String(),
+		client.StateEstablished.String(), client.StateLost.String())
+	stats := s.client.Stats()
+	m.metric("phev_client_reconnects_total", "counter", "Reconnection attempts to the car.", float64(stats.Reconnects))
+	m.metric("phev_client_bad_encodings_total", "counter", "Bad encoding messages from the car.", float64(stats.BadEncodings))
+	m.metric("phev_client_set_register_timeouts_total", "counter", "Register writes not acked in time.", float64(stats.SetRegisterTimeouts))
+	m.metric("phev_client_skipped_bytes_total", "counter", "Bytes from the car not part of a valid message.", float64(stats.SkippedBytes))
+	m.metric("phev_client_malformed_registers_total", "counter", "Registers from the car that could not be decoded.", float64(stats.MalformedRegisters))
+	m.metric("phev_client_ping_rtt_seconds", "gauge", "Round trip time of the last ping.", stats.PingRTT.Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(m.Bytes())
+}
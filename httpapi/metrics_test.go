@@ -0,0 +1,97 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+	"github.com/buxtronix/phev2mqtt/vehicle"
+)
+
+func TestMetrics(t *testing.T) {
+	v := vehicle.New()
+	for _, m := range []*protocol.PhevMessage{
+		protocol.NewRegisterMessage(protocol.BatteryLevelRegister, protocol.ModelYear18, []byte{0x50, 0x0, 0x0, 0x0}),
+		protocol.NewRegisterMessage(protocol.ChargeStatusRegister, protocol.ModelYear18, []byte{0x1, 0x5a, 0x0}),
+		protocol.NewRegisterMessage(protocol.ChargePlugRegister, protocol.ModelYear18, []byte{0x0, 0x1}),
+		protocol.NewRegisterMessage(protocol.PreACStateRegister, protocol.ModelYear18, []byte{0x2, 0x0, 0x0}),
+	} {
+		v.Update(m)
+	}
+	s := New(newClient(t, client.VehicleOption(v)))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics got=%d want=%d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("Content-Type got=%q want=%q", got, want)
+	}
+	want := `# HELP phev_battery_level_percent Drive battery level.
+# TYPE phev_battery_level_percent gauge
+phev_battery_level_percent 80
+# HELP phev_charging Whether the battery is charging.
+# TYPE phev_charging gauge
+phev_charging 1
+# HELP phev_charge_remaining_minutes Charging time remaining.
+# TYPE phev_charge_remaining_minutes gauge
+phev_charge_remaining_minutes 90
+# HELP phev_charge_plug_connected Whether the charge plug is connected.
+# TYPE phev_charge_plug_connected gauge
+phev_charge_plug_connected 1
+# HELP phev_climate_state Climate control state.
+# TYPE phev_climate_state gauge
+phev_climate_state{state="off"} 0
+phev_climate_state{state="on"} 1
+phev_climate_state{state="terminated"} 0
+# HELP phev_connection_state Connection state to the car.
+# TYPE phev_connection_state gauge
+phev_connection_state{state="disconnected"} 1
+phev_connection_state{state="connecting"} 0
+phev_connection_state{state="securing"} 0
+phev_connection_state{state="established"} 0
+phev_connection_state{state="lost"} 0
+# HELP phev_client_reconnects_total Reconnection attempts to the car.
+# TYPE phev_client_reconnects_total counter
+phev_client_reconnects_total 0
+# HELP phev_client_bad_encodings_total Bad encoding messages from the car.
+# TYPE phev_client_bad_encodings_total counter
+phev_client_bad_encodings_total 0
+# HELP phev_client_set_register_timeouts_total Register writes not acked in time.
+# TYPE phev_client_set_register_timeouts_total counter
+phev_client_set_register_timeouts_total 0
+# HELP phev_client_skipped_bytes_total Bytes from the car not part of a valid message.
+# TYPE phev_client_skipped_bytes_total counter
+phev_client_skipped_bytes_total 0
+# HELP phev_client_malformed_registers_total Registers from the car that could not be decoded.
+# TYPE phev_client_malformed_registers_total counter
+phev_client_malformed_registers_total 0
+# HELP phev_client_ping_rtt_seconds Round trip time of the last ping.
+# TYPE phev_client_ping_rtt_seconds gauge
+phev_client_ping_rtt_seconds 0
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("GET /metrics got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsBogusValues(t *testing.T) {
+	v := vehicle.New()
+	v.Update(protocol.NewRegisterMessage(protocol.BatteryLevelRegister, protocol.ModelYear18, []byte{0xff, 0x0, 0x0, 0x0}))
+	v.Update(protocol.NewRegisterMessage(protocol.ChargeStatusRegister, protocol.ModelYear18, []byte{0x0, 0xff, 0x7f}))
+	s := New(newClient(t, client.VehicleOption(v)))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, metric := range []string{"phev_battery_level_percent", "phev_charge_remaining_minutes"} {
+		if strings.Contains(body, metric) {
+			t.Errorf("GET /metrics got %s for a bogus value", metric)
+		}
+	}
+	if !strings.Contains(body, "phev_charging 0\n") {
+		t.Errorf("GET /metrics got no phev_charging 0")
+	}
+}
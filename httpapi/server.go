@@ -0,0 +1,290 @@
+// Package httpapi implements a JSON HTTP API to a Phev, on top
+// of a client.Client.
+package httpapi
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Server serves the HTTP API for a client.
+type Server struct {
+	client *client.Client
+	mux    *http.ServeMux
+	// Timeout for commands to the car.
+	timeout time.Duration
+}
+
+// New returns a Server for the client.
+func New(cl *client.Client) *Server {
+	s := &Server{
+		client:  cl,
+		mux:     http.NewServeMux(),
+		timeout: 30 * time.Second,
+	}
+	s.mux.HandleFunc("/state", s.get(s.handleState))
+	s.mux.HandleFunc("/connection", s.get(s.handleConnection))
+	s.mux.HandleFunc("/registers", s.get(s.handleRegisters))
+	s.mux.HandleFunc("/registers/", s.handleRegister)
+	s.mux.HandleFunc("/climate", s.post(s.handleClimate))
+	s.mux.HandleFunc("/lights/", s.post(s.handleLights))
+	s.mux.HandleFunc("/charge/timer/cancel", s.post(s.handleCancelChargeTimer))
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("%%PHEV_HTTP_REQUEST%%: %s %s", r.Method, r.URL.Path)
+	s.mux.ServeHTTP(w, r)
+}
+
+// A handler returns the response value, or an error.
+type handler func(r *http.Request) (interface{}, error)
+
+// httpError is an error with a status code.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func (s *Server) get(h handler) http.HandlerFunc {
+	return s.method(http.MethodGet, h)
+}
+
+func (s *Server) post(h handler) http.HandlerFunc {
+	return s.method(http.MethodPost, h)
+}
+
+func (s *Server) method(method string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)})
+			return
+		}
+		s.serve(w, r, h)
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, h handler) {
+	resp, err := h(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("%%PHEV_HTTP_WRITE_ERROR%%: %v", err)
+	}
+}
+
+// Maps err to a status code: 503 if the car is offline, 504 if the
+// car did not respond in time.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadGateway
+	var herr *httpError
+	switch {
+	case errors.As(err, &herr):
+		code = herr.code
+	case errors.Is(err, client.ErrNotConnected):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Decodes the JSON request body into v.
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("bad request body: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) commandContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.timeout)
+}
+
+func (s *Server) handleState(r *http.Request) (interface{}, error) {
+	return s.client.Vehicle.State(), nil
+}
+
+type connectionResponse struct {
+	State     string `json:"state"`
+	ModelYear string `json:"model_year"`
+}
+
+func (s *Server) handleConnection(r *http.Request) (interface{}, error) {
+	state := s.client.State()
+	year := client.ModelYearUnknown
+	// The model year is set before the connection is established.
+	if state == client.StateEstablished {
+		year = s.client.ModelYear
+	}
+	return connectionResponse{
+		State:     state.String(),
+		ModelYear: year.String(),
+	}, nil
+}
+
+func (s *Server) handleRegisters(r *http.Request) (interface{}, error) {
+	regs := map[string]string{}
+	for reg, data := range s.client.Vehicle.Registers() {
+		regs[fmt.Sprintf("%02x", reg)] = hex.EncodeToString(data)
+	}
+	return regs, nil
+}
+
+type registerResponse struct {
+	Register string `json:"register"`
+	Raw      string `json:"raw"`
+	Decoded  string `json:"decoded,omitempty"`
+}
+
+type registerRequest struct {
+	// Data is the hex encoded value to set.
+	Data string `json:"data"`
+}
+
+// Handles /registers/<xx>, GET returns the register, POST sets it.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, func(r *http.Request) (interface{}, error) {
+		name := strings.TrimPrefix(r.URL.Path, "/registers/")
+		reg, err := strconv.ParseUint(name, 16, 8)
+		if err != nil {
+			return nil, badRequest("bad register %q", name)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			data := s.client.Vehicle.Raw(byte(reg))
+			if data == nil {
+				return nil, &httpError{http.StatusNotFound, fmt.Errorf("register %02x not received", reg)}
+			}
+			resp := registerResponse{
+				Register: fmt.Sprintf("%02x", reg),
+				Raw:      hex.EncodeToString(data),
+			}
+			if decoded := s.client.LastRegister(byte(reg)); decoded != nil {
+				resp.Decoded = decoded.String()
+			}
+			return resp, nil
+		case http.MethodPost:
+			var req registerRequest
+			if err := decodeBody(r, &req); err != nil {
+				return nil, err
+			}
+			data, err := hex.DecodeString(req.Data)
+			if err != nil || len(data) == 0 {
+				return nil, badRequest("bad register data %q", req.Data)
+			}
+			ctx, cancel := s.commandContext(r)
+			defer cancel()
+			if err := s.client.SetRegister(ctx, byte(reg), data); err != nil {
+				return nil, err
+			}
+			return registerResponse{
+				Register: fmt.Sprintf("%02x", reg),
+				Raw:      req.Data,
+			}, nil
+		default:
+			return nil, &httpError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)}
+		}
+	})
+}
+
+type climateRequest struct {
+	// Mode is "cool", "heat", "windscreen" or "off".
+	Mode string `json:"mode"`
+	// Duration is in minutes, 10, 20 or 30. Defaults to 10.
+	Duration int `json:"duration"`
+}
+
+func (s *Server) handleClimate(r *http.Request) (interface{}, error) {
+	var req climateRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.commandContext(r)
+	defer cancel()
+	if strings.ToLower(req.Mode) == "off" {
+		if _, err := s.client.StopClimate(ctx); err != nil {
+			return nil, err
+		}
+		return s.client.Vehicle.State().Climate, nil
+	}
+	mode, err := client.ParseClimateMode(req.Mode)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if req.Duration == 0 {
+		req.Duration = 10
+	}
+	if req.Duration != 10 && req.Duration != 20 && req.Duration != 30 {
+		return nil, badRequest("bad duration %d, must be 10, 20 or 30", req.Duration)
+	}
+	if _, err := s.client.StartClimate(ctx, mode, time.Duration(req.Duration)*time.Minute); err != nil {
+		return nil, err
+	}
+	return s.client.Vehicle.State().Climate, nil
+}
+
+type lightsRequest struct {
+	On bool `json:"on"`
+}
+
+// Handles /lights/head and /lights/parking.
+func (s *Server) handleLights(r *http.Request) (interface{}, error) {
+	var req lightsRequest
+	if err := decodeBody(r, &req); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.commandContext(r)
+	defer cancel()
+	var err error
+	switch light := strings.TrimPrefix(r.URL.Path, "/lights/"); light {
+	case "head":
+		_, err = s.client.SetHeadlights(ctx, req.On)
+	case "parking":
+		_, err = s.client.SetParkingLights(ctx, req.On)
+	default:
+		return nil, &httpError{http.StatusNotFound, fmt.Errorf("unknown lights %q", light)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Vehicle.State().Lights, nil
+}
+
+func (s *Server) handleCancelChargeTimer(r *http.Request) (interface{}, error) {
+	ctx, cancel := s.commandContext(r)
+	defer cancel()
+	if err := s.client.CancelChargeTimer(ctx); err != nil {
+		return nil, err
+	}
+	return s.client.Vehicle.State().Charge, nil
+}
@@ -0,0 +1,154 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/client"
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// Listens as a car that starts the connection, then never acks
+// anything. Returns its address.
+func silentCar(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return
+		}
+		key := &protocol.SecurityKey{}
+		start := protocol.NewMessage(protocol.CmdInMy18StartReq, 0x1, false, append(key.GenerateProposal(), 0x1))
+		conn.Write(start.EncodeToBytes(&protocol.SecurityKey{}))
+		io.Copy(io.Discard, conn)
+	}()
+	return l.Addr().String()
+}
+
+func newClient(t *testing.T, opts ...client.Option) *client.Client {
+	t.Helper()
+	cl, err := client.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// Serves the request, returning the status code and JSON error.
+func serve(t *testing.T, s *Server, method, path, body string) (int, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if w.Code != http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s %s: bad error body %q: %v", method, path, w.Body, err)
+		}
+	}
+	return w.Code, resp.Error
+}
+
+func TestWriteError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want int
+	}{
+		{badRequest("bad"), http.StatusBadRequest},
+		{fmt.Errorf("setting: %w", client.ErrNotConnected), http.StatusServiceUnavailable},
+		{fmt.Errorf("timed out: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{errors.New("listener channel closed"), http.StatusBadGateway},
+	} {
+		w := httptest.NewRecorder()
+		writeError(w, test.err)
+		if w.Code != test.want {
+			t.Errorf("writeError(%v) got=%d want=%d", test.err, w.Code, test.want)
+		}
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	s := New(newClient(t))
+	for _, test := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodGet, "/registers/zz", "", http.StatusBadRequest},
+		{http.MethodGet, "/registers/100", "", http.StatusBadRequest},
+		{http.MethodGet, "/registers/1d", "", http.StatusNotFound},
+		{http.MethodPost, "/registers/1d", "{", http.StatusBadRequest},
+		{http.MethodPost, "/registers/1d", `{"data": "zz"}`, http.StatusBadRequest},
+		{http.MethodPost, "/registers/1d", `{"data": ""}`, http.StatusBadRequest},
+		{http.MethodDelete, "/registers/1d", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/climate", `{"mode": "warm"}`, http.StatusBadRequest},
+		{http.MethodPost, "/climate", `{"mode": "heat", "duration": 15}`, http.StatusBadRequest},
+		{http.MethodPost, "/climate", `{"mode": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/lights/fog", `{"on": true}`, http.StatusNotFound},
+		{http.MethodGet, "/climate", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/state", "", http.StatusMethodNotAllowed},
+	} {
+		if got, _ := serve(t, s, test.method, test.path, test.body); got != test.want {
+			t.Errorf("%s %s %s got=%d want=%d", test.method, test.path, test.body, got, test.want)
+		}
+	}
+}
+
+func TestNotConnected(t *testing.T) {
+	s := New(newClient(t))
+	for _, test := range []struct {
+		path, body string
+	}{
+		{"/registers/1d", `{"data": "00"}`},
+		{"/climate", `{"mode": "heat"}`},
+		{"/climate", `{"mode": "off"}`},
+		{"/lights/head", `{"on": true}`},
+		{"/lights/parking", `{"on": false}`},
+		{"/charge/timer/cancel", ""},
+	} {
+		if got, msg := serve(t, s, http.MethodPost, test.path, test.body); got != http.StatusServiceUnavailable {
+			t.Errorf("POST %s got=%d (%s) want=%d", test.path, got, msg, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	cl := newClient(t, client.AddressOption(silentCar(t)))
+	defer cl.Close()
+	if err := cl.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range cl.Recv {
+		}
+	}()
+	if err := cl.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := New(cl)
+	s.timeout = 50 * time.Millisecond
+	if got, msg := serve(t, s, http.MethodPost, "/registers/1d", `{"data": "00"}`); got != http.StatusGatewayTimeout {
+		t.Errorf("POST /registers/1d got=%d (%s) want=%d", got, msg, http.StatusGatewayTimeout)
+	}
+	if got := cl.Stats().SetRegisterTimeouts; got != 1 {
+		t.Errorf("SetRegisterTimeouts got=%d want=1", got)
+	}
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import "sync"
+
+// A Direction is the direction a message is sent in.
+type Direction int
+
+const (
+	// FromCar is from the car to the client.
+	FromCar Direction = iota
+	// ToCar is from the client to the car.
+	ToCar
+)
+
+// A RegisterFactory returns an empty Register to decode a register into.
+type RegisterFactory func() Register
+
+type codecKey struct {
+	dir  Direction
+	reg  byte
+	year ModelYear
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[codecKey]RegisterFactory{}
+)
+
+// RegisterCodec registers the factory for a register sent by the car,
+// replacing any already registered. A codec for ModelYearUnknown is
+// used for model years without their own.
+func RegisterCodec(reg byte, year ModelYear, factory RegisterFactory) {
+	RegisterDirectionCodec(FromCar, reg, year, factory)
+}
+
+// RegisterDirectionCodec registers the factory for a register sent
+// in the direction. Registers sent to the car are only decoded if
+// registered.
+func RegisterDirectionCodec(dir Direction, reg byte, year ModelYear, factory RegisterFactory) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[codecKey{dir, reg, year}] = factory
+}
+
+// Returns the factory for the register, or nil.
+func lookupCodec(dir Direction, reg byte, year ModelYear) RegisterFactory {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	if f, ok := codecs[codecKey{dir, reg, year}]; ok {
+		return f
+	}
+	return codecs[codecKey{dir, reg, ModelYearUnknown}]
+}
+
+// NewRegisterFor returns an empty Register to decode the register
+// into, for the direction and model year. It is a RegisterGeneric if
+// the register has no codec.
+func NewRegisterFor(dir Direction, register byte, year ModelYear) Register {
+	if f := lookupCodec(dir, register, year); f != nil {
+		return f()
+	}
+	return &RegisterGeneric{}
+}
+
+func init() {
+	for reg, f := range map[byte]RegisterFactory{
+		VINRegister:            func() Register { return new(RegisterVIN) },
+		SettingsRegister:       func() Register { return new(RegisterSettings) },
+		TimeRegister:           func() Register { return new(RegisterTime) },
+		ECUVersionRegister:     func() Register { return new(RegisterECUVersion) },
+		BatteryLevelRegister:   func() Register { return new(RegisterBatteryLevel) },
+		BatteryWarningRegister: func() Register { return new(RegisterBatteryWarning) },
+		ChargeTimerRegister:    func() Register { return new(RegisterChargeTimer) },
+		ClimateTimerRegister:   func() Register { return new(RegisterClimateTimer) },
+		DoorStatusRegister:     func() Register { return new(RegisterDoorStatus) },
+		ChargePlugRegister:     func() Register { return new(RegisterChargePlug) },
+		ChargeStatusRegister:   func() Register { return new(RegisterChargeStatus) },
+		PreACStateRegister:     func() Register { return new(RegisterPreACState) },
+		ACOperStatusRegister:   func() Register { return new(RegisterACOperStatus) },
+		ACModeRegister:         func() Register { return new(RegisterACMode) },
+		WIFISSIDRegister:       func() Register { return new(RegisterWIFISSID) },
+		LightStatusRegister:    func() Register { return new(RegisterLightStatus) },
+	} {
+		RegisterCodec(reg, ModelYearUnknown, f)
+	}
+	// Registers with a different data length in each model year.
+	for _, year := range []ModelYear{ModelYear14, ModelYear18} {
+		year := year
+		RegisterCodec(PreACStateRegister, year, func() Register { return &RegisterPreACState{year: year} })
+		RegisterCodec(ACOperStatusRegister, year, func() Register { return &RegisterACOperStatus{year: year} })
+	}
+}
@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// testRegister is a codec for an undocumented register.
+type testRegister struct {
+	RegisterGeneric
+}
+
+func (r *testRegister) Decode(m *PhevMessage) error {
+	r.Reg = m.Register
+	r.Value = m.Data
+	return nil
+}
+
+// Restores the codecs registered by the test when it completes.
+func restoreCodecs(t *testing.T) {
+	codecMu.Lock()
+	saved := map[codecKey]RegisterFactory{}
+	for k, f := range codecs {
+		saved[k] = f
+	}
+	codecMu.Unlock()
+	t.Cleanup(func() {
+		codecMu.Lock()
+		defer codecMu.Unlock()
+		codecs = saved
+	})
+}
+
+func TestRegisterCodec(t *testing.T) {
+	restoreCodecs(t)
+	const reg = 0xfe
+	RegisterCodec(reg, ModelYear14, func() Register { return new(testRegister) })
+	RegisterDirectionCodec(ToCar, reg, ModelYearUnknown, func() Register { return new(testRegister) })
+
+	// Decodes a message from its encoded form, as the model year.
+	decode := func(typ byte, year ModelYear) *PhevMessage {
+		key := &SecurityKey{ModelYear: year}
+		msg := NewMessage(typ, reg, false, []byte{0x1, 0x2})
+		msgs := NewFromBytes(msg.EncodeToBytes(&SecurityKey{}), key)
+		if len(msgs) != 1 {
+			t.Fatalf("NewFromBytes() got %d messages, want 1", len(msgs))
+		}
+		return msgs[0]
+	}
+
+	if _, ok := decode(CmdInResp, ModelYear14).Reg.(*testRegister); !ok {
+		t.Errorf("MY14 register from car: want testRegister")
+	}
+	if _, ok := decode(CmdInResp, ModelYear18).Reg.(*RegisterGeneric); !ok {
+		t.Errorf("MY18 register from car: want RegisterGeneric")
+	}
+	if _, ok := decode(CmdOutSend, ModelYear18).Reg.(*testRegister); !ok {
+		t.Errorf("Register to car: want testRegister")
+	}
+	if r := decode(CmdOutSend, ModelYear18).Reg; r == nil || hex.EncodeToString(r.Encode().Data) != "0102" {
+		t.Errorf("Register to car: got %v, want data 0102", r)
+	}
+	// Registers to the car without a codec are not decoded.
+	msgs := NewFromBytes(NewMessage(CmdOutSend, 0x0a, false, []byte{0x1}).EncodeToBytes(&SecurityKey{}), &SecurityKey{})
+	if len(msgs) != 1 || msgs[0].Reg != nil {
+		t.Errorf("Register to car without codec: got %v, want no register", msgs)
+	}
+}
+
+func TestModelYearCodecs(t *testing.T) {
+	tests := []struct {
+		register byte
+		year     ModelYear
+		in       string
+		wantErr  bool
+	}{
+		{PreACStateRegister, ModelYear14, "02", false},
+		{PreACStateRegister, ModelYear14, "020000", true},
+		{PreACStateRegister, ModelYear18, "020000", false},
+		{PreACStateRegister, ModelYear18, "02", true},
+		{PreACStateRegister, ModelYearUnknown, "020000", false},
+		{PreACStateRegister, ModelYear24, "020000", false},
+		{ACOperStatusRegister, ModelYear14, "0401", false},
+		{ACOperStatusRegister, ModelYear14, "0401000000", true},
+		{ACOperStatusRegister, ModelYear18, "0401000000", false},
+		{ACOperStatusRegister, ModelYear18, "0401", true},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := NewRegisterMessage(test.register, test.year, data)
+		if gotErr := msg.Err != nil; gotErr != test.wantErr {
+			t.Errorf("0x%02x %s %q: Err got=%v wantErr=%t", test.register, test.year, test.in, msg.Err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if diff := hexCmp(msg.Reg.Encode().Data, test.in); diff != "" {
+			t.Errorf("0x%02x %s Encode(): %s", test.register, test.year, diff)
+		}
+	}
+}
+
+func TestStartModelYear(t *testing.T) {
+	key := &SecurityKey{}
+	data, err := hex.DecodeString("5e0c0001becfe9adada5158b0181")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewFromBytes(data, key)
+	if key.ModelYear != ModelYear18 {
+		t.Errorf("ModelYear got=%s want=%s", key.ModelYear, ModelYear18)
+	}
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Decoder reads messages from a stream, such as a TCP connection
+// to the car. Messages may be split across reads, or several may
+// arrive in one. Corrupt data is skipped until the next valid message.
+type Decoder struct {
+	r   io.Reader
+	key *SecurityKey
+	// Data read but not yet decoded.
+	buf []byte
+	// The error from the last read, returned once buf is used up.
+	err     error
+	skipped int64
+}
+
+// NewDecoder returns a Decoder reading from r, tracking the security
+// key in key.
+func NewDecoder(r io.Reader, key *SecurityKey) *Decoder {
+	return &Decoder{r: r, key: key}
+}
+
+// Decode returns the next message. At the end of the stream, it returns
+// the reader's error, or io.ErrUnexpectedEOF if it ends with a partial
+// message.
+func (d *Decoder) Decode() (*PhevMessage, error) {
+	for {
+		start, end, ok := FindMessage(d.buf)
+		d.skip(start)
+		if ok {
+			data := append([]byte{}, d.buf[:end-start]...)
+			d.buf = d.buf[end-start:]
+			p := &PhevMessage{}
+			if err := p.DecodeFromBytes(data, d.key); err != nil {
+				// Already removed from buf.
+				log.Debugf("%%PHEV_DECODER_SKIP%%: %s: %v", hex.EncodeToString(data), err)
+				d.skipped += int64(len(data))
+				continue
+			}
+			return p, nil
+		}
+		if d.err != nil {
+			if len(d.buf) > 0 && d.err == io.EOF {
+				// The partial message may not be one, so look
+				// for messages after its start.
+				d.skip(1)
+				if len(d.buf) == 0 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				continue
+			}
+			return nil, d.err
+		}
+		d.read()
+	}
+}
+
+// Skipped returns the number of bytes skipped, as they were not part
+// of a valid message.
+func (d *Decoder) Skipped() int64 {
+	return d.skipped
+}
+
+func (d *Decoder) skip(n int) {
+	if n <= 0 {
+		return
+	}
+	log.Debugf("%%PHEV_DECODER_SKIP%%: %s", hex.EncodeToString(d.buf[:n]))
+	d.skipped += int64(n)
+	d.buf = d.buf[n:]
+}
+
+func (d *Decoder) read() {
+	data := make([]byte, 4096)
+	n, err := d.r.Read(data)
+	if n > 0 {
+		log.Tracef("%%PHEV_DECODER_READ%%: %s", hex.EncodeToString(data[:n]))
+		d.buf = append(d.buf, data[:n]...)
+	}
+	d.err = err
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// Wrap the reader, e.g to split reads.
+		reader  func(io.Reader) io.Reader
+		want    []string
+		skipped int64
+		err     error
+	}{{
+		name: "one message",
+		in:   "f304000a0001",
+		want: []string{"f304000a0001"},
+		err:  io.EOF,
+	}, {
+		name: "messages in one read",
+		in:   "f304000a00013f04010a004e",
+		want: []string{"f304000a0001", "3f04010a004e"},
+		err:  io.EOF,
+	}, {
+		name:   "messages split across reads",
+		in:     "f304000a00013f04010a004e",
+		reader: iotest.OneByteReader,
+		want:   []string{"f304000a0001", "3f04010a004e"},
+		err:    io.EOF,
+	}, {
+		name:    "garbage between messages",
+		in:      "f304000a0001aabbccf304000b0002",
+		reader:  iotest.HalfReader,
+		want:    []string{"f304000a0001", "f304000b0002"},
+		skipped: 3,
+		err:     io.EOF,
+	}, {
+		name:    "partial message at end",
+		in:      "f304000a0001f30400",
+		want:    []string{"f304000a0001"},
+		skipped: 3,
+		err:     io.ErrUnexpectedEOF,
+	}, {
+		// The length byte excludes the type and length.
+		name:   "longest message",
+		in:     "6fff0002" + strings.Repeat("00", 252) + "70f304000a0001",
+		reader: iotest.OneByteReader,
+		want:   []string{"6fff0002" + strings.Repeat("00", 252) + "70", "f304000a0001"},
+		err:    io.EOF,
+	}, {
+		// Not a message in the data of one being received.
+		name:   "message inside partial message",
+		in:     "6f0d000206f4f0f6f3f30000000044",
+		reader: iotest.OneByteReader,
+		want:   []string{"6f0d000206f4f0f6f3f30000000044"},
+		err:    io.EOF,
+	}, {
+		// A partial message at the end may not be one.
+		name:    "message after partial message at end",
+		in:      "6f0d000206f4f0f6f3f3",
+		want:    []string{"06f4f0f6f3f3"},
+		skipped: 4,
+		err:     io.EOF,
+	}, {
+		// Only valid with the xor flipped from the ack byte.
+		name: "flipped xor",
+		in:   "1002001229f304000a0001",
+		want: []string{"1002001229", "f304000a0001"},
+		err:  io.EOF,
+	}, {
+		name:   "read error",
+		in:     "f304000a0001",
+		reader: iotest.TimeoutReader,
+		want:   []string{"f304000a0001"},
+		err:    iotest.ErrTimeout,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r io.Reader = bytes.NewReader(in)
+			if test.reader != nil {
+				r = test.reader(r)
+			}
+			d := NewDecoder(r, &SecurityKey{})
+			got := []string{}
+			for {
+				msg, err := d.Decode()
+				if err != nil {
+					if err != test.err {
+						t.Errorf("Decode() got err=%v want=%v", err, test.err)
+					}
+					break
+				}
+				got = append(got, hex.EncodeToString(msg.OriginalXored))
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Decode() got=%v want=%v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("Decode() message %d got=%s want=%s", i, got[i], test.want[i])
+				}
+			}
+			if d.Skipped() != test.skipped {
+				t.Errorf("Skipped() got=%d want=%d", d.Skipped(), test.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// messageJSON is the JSON form of a PhevMessage.
+type messageJSON struct {
+	Type     string `json:"type"`
+	TypeName string `json:"type_name,omitempty"`
+	Ack      bool   `json:"ack"`
+	Register string `json:"register"`
+	Data     string `json:"data"`
+	Xor      string `json:"xor"`
+	// Decoded is the register String() form.
+	Decoded string `json:"decoded,omitempty"`
+	// Fields are the decoded register fields.
+	Fields Register `json:"fields,omitempty"`
+	// Error is why the register could not be decoded.
+	Error string `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the message with its decoded register, if any.
+// Registers without a decoder are sent as the raw data only.
+func (p *PhevMessage) MarshalJSON() ([]byte, error) {
+	m := messageJSON{
+		Type:     fmt.Sprintf("%02x", p.Type),
+		TypeName: messageStr[p.Type],
+		Ack:      p.Ack == Ack,
+		Register: fmt.Sprintf("%02x", p.Register),
+		Data:     hex.EncodeToString(p.Data),
+		Xor:      fmt.Sprintf("%02x", p.Xor),
+	}
+	if p.Reg != nil {
+		m.Decoded = p.Reg.String()
+		if _, ok := p.Reg.(*RegisterGeneric); !ok {
+			m.Fields = p.Reg
+		}
+	}
+	if p.Err != nil {
+		m.Error = p.Err.Error()
+	}
+	return json.Marshal(m)
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessageMarshalJSON(t *testing.T) {
+	msg := &PhevMessage{
+		Type:     CmdInResp,
+		Register: PreACStateRegister,
+		Data:     []byte{0x2, 0x0, 0x0},
+		Xor:      0x1a,
+	}
+	msg.Reg = &RegisterPreACState{}
+	if err := msg.Reg.Decode(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want := `{"type":"6f","type_name":"RespCmd","ack":false,"register":"10","data":"020000","xor":"1a","decoded":"Pre-AC on","fields":{"State":"on"}}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+
+	ping := NewPingResponseMessage(0xa)
+	got, err = json.Marshal(ping)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want = `{"type":"3f","type_name":"PingResp","ack":true,"register":"0a","data":"00","xor":"00"}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+
+	// Decoded messages have the xor they were sent with.
+	msgs := NewFromBytes(XorMessageWith([]byte{0x3f, 0x04, 0x01, 0x0a, 0x00, 0x4e}, 0x12), &SecurityKey{})
+	if len(msgs) != 1 {
+		t.Fatalf("NewFromBytes() got %d messages, want 1", len(msgs))
+	}
+	got, err = json.Marshal(msgs[0])
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want = `{"type":"3f","type_name":"PingResp","ack":true,"register":"0a","data":"00","xor":"12"}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+
+	bad := NewRegisterMessage(BatteryLevelRegister, ModelYearUnknown, []byte{0x50})
+	got, err = json.Marshal(bad)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want = `{"type":"6f","type_name":"RespCmd","ack":false,"register":"1d","data":"50","xor":"00","decoded":"g(0x1d): 50","error":"register 0x1d: unexpected data length 1, want [4]"}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+}
+
+func TestTimerMarshalJSON(t *testing.T) {
+	charge := ChargeTimer{State: TimerEnabled, Days: 0x7d, StartHour: 22, StopHour: 7}
+	got, err := json.Marshal(charge)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want := `{"state":"enabled","days":"sun,tue,wed,thu,fri,sat","start_hour":22,"start_minute":0,"stop_hour":7,"stop_minute":0}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+
+	climate, err := NewClimateTimer(7, 50, 20, 0x1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = json.Marshal(climate)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error: %v", err)
+	}
+	want = `{"state":"enabled","days":"sun","hour":7,"minute":50,"duration":20}`
+	if string(got) != want {
+		t.Errorf("Marshal() got=%s want=%s", got, want)
+	}
+}
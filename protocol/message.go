@@ -1,10 +1,12 @@
 package protocol
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -60,7 +62,7 @@ var messageStr = map[byte]string{
 
 type PhevMessage struct {
 	Type          byte
-	Length        byte
+	Length        int
 	Ack           byte
 	Register      byte
 	Data          []byte
@@ -69,6 +71,9 @@ type PhevMessage struct {
 	Original      []byte
 	OriginalXored []byte
 	Reg           Register
+	// Err is the error decoding Reg, which is then a RegisterGeneric
+	// with the raw data.
+	Err error
 }
 
 func (p *PhevMessage) ShortForm() string {
@@ -93,6 +98,9 @@ func (p *PhevMessage) ShortForm() string {
 
 	case CmdInResp:
 		if p.Ack == Request {
+			if p.Err != nil {
+				return fmt.Sprintf("REGISTER NTFY (reg 0x%02x data %s) [malformed: %v]", p.Register, hex.EncodeToString(p.Data), p.Err)
+			}
 			if p.Reg != nil {
 				return fmt.Sprintf("REGISTER NTFY (reg 0x%02x data %s) [%s]", p.Register, hex.EncodeToString(p.Data), p.Reg.String())
 			} else {
@@ -157,107 +165,88 @@ func (p *PhevMessage) EncodeToBytes(key *SecurityKey) []byte {
 }
 
 func (p *PhevMessage) DecodeFromBytes(data []byte, key *SecurityKey) error {
-	if len(data) < 4 {
-		return fmt.Errorf("invalid packet length")
-	}
-	p.OriginalXored = data
-	data, xor, _ := ValidateAndDecodeMessage(data)
-	if len(data) < 4 || len(data) < int(data[1]+2) {
-		return fmt.Errorf("invalid packet length")
+	// Decode with the same xor and length as the decoder found.
+	start, end, xor, ok := findMessage(data)
+	if !ok || start != 0 {
+		return fmt.Errorf("invalid message")
 	}
+	p.OriginalXored = data[:end]
+	data = XorMessageWith(data[:end], xor)
 	p.Type = data[0]
-	p.Length = data[1] + 2
+	p.Length = end
 	p.Register = data[3]
-	p.Data = data[4 : p.Length-1]
-	p.Checksum = data[p.Length-1]
+	p.Data = data[4 : end-1]
+	p.Checksum = data[end-1]
 	p.Ack = data[2]
 	p.Xor = xor
 	p.Original = data
 	switch p.Type {
 	case CmdInMy24StartReq, CmdInMy18StartReq, CmdInMy14StartReq:
 		key.Update(p.OriginalXored)
+		key.ModelYear = StartModelYear(p.Type)
 	case CmdInResp:
 		key.RKey(true)
 	case CmdOutSend:
 		key.SKey(true)
 	}
-	if p.Type == CmdInResp && p.Ack == Request {
-		switch p.Register {
-		case VINRegister:
-			p.Reg = new(RegisterVIN)
-		case SettingsRegister:
-			p.Reg = new(RegisterSettings)
-		case TimeRegister:
-			p.Reg = new(RegisterTime)
-		case ECUVersionRegister:
-			p.Reg = new(RegisterECUVersion)
-		case BatteryLevelRegister:
-			p.Reg = new(RegisterBatteryLevel)
-		case BatteryWarningRegister:
-			p.Reg = new(RegisterBatteryWarning)
-		case DoorStatusRegister:
-			p.Reg = new(RegisterDoorStatus)
-		case ChargePlugRegister:
-			p.Reg = new(RegisterChargePlug)
-		case ChargeStatusRegister:
-			p.Reg = new(RegisterChargeStatus)
-		case PreACStateRegister:
-			p.Reg = new(RegisterPreACState)
-		case ACOperStatusRegister:
-			p.Reg = new(RegisterACOperStatus)
-		case ACModeRegister:
-			p.Reg = new(RegisterACMode)
-		case WIFISSIDRegister:
-			p.Reg = new(RegisterWIFISSID)
-		case LightStatusRegister:
-			p.Reg = new(RegisterLightStatus)
-		default:
-			p.Reg = new(RegisterGeneric)
+	if p.Ack == Request {
+		switch p.Type {
+		case CmdInResp:
+			p.decodeRegister(NewRegisterFor(FromCar, p.Register, key.ModelYear))
+		case CmdOutSend:
+			if f := lookupCodec(ToCar, p.Register, key.ModelYear); f != nil {
+				p.decodeRegister(f())
+			}
 		}
-		p.Reg.Decode(p)
 	}
 
 	return nil
 }
 
+// Decodes the data into reg, falling back to a RegisterGeneric with
+// Err set if the data is malformed.
+func (p *PhevMessage) decodeRegister(reg Register) {
+	p.Reg = reg
+	if p.Err = reg.Decode(p); p.Err != nil {
+		p.Reg = &RegisterGeneric{Reg: p.Register, Value: p.Data}
+	}
+}
+
+// NewRegister returns an empty Register to decode the register
+// into, a RegisterGeneric if the register is not known.
+func NewRegister(register byte) Register {
+	return NewRegisterFor(FromCar, register, ModelYearUnknown)
+}
+
+// NewRegisterMessage returns a register update message from the
+// car, with the register decoded as the model year sends it. Err is
+// set if the data is malformed.
+func NewRegisterMessage(register byte, year ModelYear, data []byte) *PhevMessage {
+	p := NewMessage(CmdInResp, register, false, data)
+	p.decodeRegister(NewRegisterFor(FromCar, register, year))
+	return p
+}
+
 func (p *PhevMessage) String() string {
 	return fmt.Sprintf(
 		`Cmd: 0x%x (%s) (len %d), Register 0x%x, Data: %s`,
 		p.Type, messageStr[p.Type], p.Length, p.Register, hex.EncodeToString(p.Data))
 }
 
+// NewFromBytes decodes the messages in data, skipping corrupt data
+// and any partial message at the end.
 func NewFromBytes(data []byte, key *SecurityKey) []*PhevMessage {
 	msgs := []*PhevMessage{}
 
 	log.Tracef("%%PHEV_DECODE_FROM_BYTES%%: Raw: %s", hex.EncodeToString(data))
-	offset := 0
+	d := NewDecoder(bytes.NewReader(data), key)
 	for {
-		dat, xor, rem := ValidateAndDecodeMessage(data[offset:])
-		if len(dat) == 0 {
-			offset += 1
-			if offset >= len(data)-6 {
-				break
-			}
-			continue
-		}
-		log.Tracef("%%PHEV_DECODED_FROM_BYTES%%: Raw: %s", hex.EncodeToString(dat))
-		dat = XorMessageWith(dat, xor)
-		p := &PhevMessage{}
-		err := p.DecodeFromBytes(dat, key)
-		p.OriginalXored = data[offset : offset+len(dat)]
-		p.Xor = xor
+		msg, err := d.Decode()
 		if err != nil {
-			log.Errorf("decode error: %v\n", err)
-			break
+			return msgs
 		}
-		msgs = append(msgs, p)
-		if len(rem) < 1 {
-			break
-		}
-		data = rem
-		offset = 0
+		msgs = append(msgs, msg)
 	}
-	return msgs
 }
 
 func encodeTime(t time.Time) []byte {
@@ -283,28 +272,96 @@ func decodeTime(m []byte) time.Time {
 }
 
 const (
-	BatteryWarningRegister   = 0x02
-	SetACModeRegisterMY14    = 0x02
-	SetACEnabledRegisterMY14 = 0x04
-	PreACStateRegister       = 0x10
-	TimeRegister             = 0x12
-	SetAckPreACTermRegister  = 0x13
-	VINRegister              = 0x15
-	SettingsRegister         = 0x16
-	ACOperStatusRegister     = 0x1a
-	SetACModeRegisterMY18    = 0x1b
-	ACModeRegister           = 0x1c
-	BatteryLevelRegister     = 0x1d
-	ChargePlugRegister       = 0x1e
-	ChargeStatusRegister     = 0x1f
-	LightStatusRegister      = 0x23
-	DoorStatusRegister       = 0x24
-	WIFISSIDRegister         = 0x28
-	ECUVersionRegister       = 0xc0
+	BatteryWarningRegister      = 0x02
+	SetACModeRegisterMY14       = 0x02
+	ChargeTimerRegister         = 0x04
+	SetACEnabledRegisterMY14    = 0x04
+	ClimateTimerRegister        = 0x05
+	SetHeadlightsRegister       = 0x0a
+	SetParkingLightsRegister    = 0x0b
+	PreACStateRegister          = 0x10
+	SetRegisterClientRegister   = 0x10
+	TimeRegister                = 0x12
+	SetAckPreACTermRegister     = 0x13
+	VINRegister                 = 0x15
+	SetUnregisterClientRegister = 0x15
+	SettingsRegister            = 0x16
+	CancelChargeTimerRegister   = 0x17
+	ACOperStatusRegister        = 0x1a
+	SetClimateTimerRegister     = 0x1a
+	SetACModeRegisterMY18       = 0x1b
+	ACModeRegister              = 0x1c
+	BatteryLevelRegister        = 0x1d
+	ChargePlugRegister          = 0x1e
+	ChargeStatusRegister        = 0x1f
+	LightStatusRegister         = 0x23
+	DoorStatusRegister          = 0x24
+	WIFISSIDRegister            = 0x28
+	ECUVersionRegister          = 0xc0
 )
 
+// A LengthError is returned when decoding register data of a length
+// the register does not know.
+type LengthError struct {
+	Register byte
+	Length   int
+	// Want are the known lengths.
+	Want []int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("register 0x%02x: unexpected data length %d, want %v", e.Register, e.Length, e.Want)
+}
+
+var strict int32
+
+// SetStrict sets whether registers only accept their known data
+// lengths. Otherwise, registers that decode the start of their data
+// accept longer data. Tests use strict mode to catch unknown lengths.
+func SetStrict(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&strict, v)
+}
+
+// Strict returns whether strict mode is on.
+func Strict() bool {
+	return atomic.LoadInt32(&strict) == 1
+}
+
+// Returns a LengthError unless the data has one of the lengths.
+func checkLength(m *PhevMessage, want ...int) error {
+	for _, l := range want {
+		if len(m.Data) == l {
+			return nil
+		}
+	}
+	return &LengthError{Register: m.Register, Length: len(m.Data), Want: want}
+}
+
+// Returns a LengthError if the data is shorter than the first length,
+// or in strict mode is not one of the lengths.
+func checkMinLength(m *PhevMessage, want ...int) error {
+	if Strict() || len(m.Data) < want[0] {
+		return checkLength(m, want...)
+	}
+	return nil
+}
+
+// Returns an error if the message is not for the register.
+func checkRegister(m *PhevMessage, register byte) error {
+	if m.Register != register {
+		return fmt.Errorf("register 0x%02x: cannot decode as 0x%02x", m.Register, register)
+	}
+	return nil
+}
+
+// A Register is the value of a car register. Decode returns an error
+// if the data is malformed.
 type Register interface {
-	Decode(*PhevMessage)
+	Decode(*PhevMessage) error
 	Encode() *PhevMessage
 	Raw() string
 	String() string
@@ -316,9 +373,10 @@ type RegisterGeneric struct {
 	Value []byte
 }
 
-func (r *RegisterGeneric) Decode(m *PhevMessage) {
+func (r *RegisterGeneric) Decode(m *PhevMessage) error {
 	r.Reg = m.Register
 	r.Value = m.Data
+	return nil
 }
 
 func (r *RegisterGeneric) Encode() *PhevMessage {
@@ -345,12 +403,13 @@ type RegisterTime struct {
 	raw  []byte
 }
 
-func (r *RegisterTime) Decode(m *PhevMessage) {
-	if len(m.Data) != 7 {
-		return
+func (r *RegisterTime) Decode(m *PhevMessage) error {
+	if err := checkLength(m, 7); err != nil {
+		return err
 	}
 	r.Time = decodeTime(m.Data)
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterTime) Encode() *PhevMessage {
@@ -373,13 +432,17 @@ func (r *RegisterTime) Register() byte {
 }
 
 type RegisterSettings struct {
+	Settings []Setting
 	register byte
 	raw      []byte
 }
 
-func (r *RegisterSettings) Decode(m *PhevMessage) {
+func (r *RegisterSettings) Decode(m *PhevMessage) error {
 	r.register = m.Register
 	r.raw = m.Data
+	var err error
+	r.Settings, err = DecodeSettings(m.Data)
+	return err
 }
 
 func (r *RegisterSettings) Encode() *PhevMessage {
@@ -394,8 +457,14 @@ func (r *RegisterSettings) Raw() string {
 }
 
 func (r *RegisterSettings) String() string {
-	value := binary.LittleEndian.Uint64(r.raw)
-	return fmt.Sprintf("Car Settings: %016x", value)
+	if len(r.Settings) == 0 {
+		return fmt.Sprintf("Car Settings: %s", r.Raw())
+	}
+	settings := []string{}
+	for _, s := range r.Settings {
+		settings = append(settings, s.String())
+	}
+	return "Car Settings: " + strings.Join(settings, " ")
 }
 
 func (r *RegisterSettings) Register() byte {
@@ -408,13 +477,17 @@ type RegisterVIN struct {
 	raw           []byte
 }
 
-func (r *RegisterVIN) Decode(m *PhevMessage) {
-	if m.Register != VINRegister || len(m.Data) != 20 {
-		return
+func (r *RegisterVIN) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, VINRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 20); err != nil {
+		return err
 	}
 	r.VIN = string(m.Data[1:17])
 	r.Registrations = int(m.Data[19])
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterVIN) Encode() *PhevMessage {
@@ -445,12 +518,16 @@ type RegisterECUVersion struct {
 	raw     []byte
 }
 
-func (r *RegisterECUVersion) Decode(m *PhevMessage) {
-	if m.Register != ECUVersionRegister || len(m.Data) != 13 {
-		return
+func (r *RegisterECUVersion) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, ECUVersionRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 13); err != nil {
+		return err
 	}
 	r.Version = string(m.Data[:9])
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterECUVersion) Encode() *PhevMessage {
@@ -480,17 +557,21 @@ type RegisterBatteryLevel struct {
 	raw           []byte
 }
 
-func (r *RegisterBatteryLevel) Decode(m *PhevMessage) {
-	if m.Register != BatteryLevelRegister || len(m.Data) != 4 {
-		return
+func (r *RegisterBatteryLevel) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, BatteryLevelRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 4); err != nil {
+		return err
 	}
 	r.Level = int(m.Data[0])
 	r.ParkingLights = m.Data[2] == 0x1
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterBatteryLevel) Encode() *PhevMessage {
-	data := []byte{byte(r.Level), 0x0, 0x0}
+	data := []byte{byte(r.Level), 0x0, 0x0, 0x0}
 	if r.ParkingLights {
 		data[2] = 0x1
 	}
@@ -518,12 +599,16 @@ type RegisterBatteryWarning struct {
 	raw     []byte
 }
 
-func (r *RegisterBatteryWarning) Decode(m *PhevMessage) {
-	if m.Register != BatteryWarningRegister || len(m.Data) != 4 {
-		return
+func (r *RegisterBatteryWarning) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, BatteryWarningRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 4); err != nil {
+		return err
 	}
 	r.Warning = int(m.Data[2])
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterBatteryWarning) Encode() *PhevMessage {
@@ -557,9 +642,12 @@ type RegisterDoorStatus struct {
 	raw        []byte
 }
 
-func (r *RegisterDoorStatus) Decode(m *PhevMessage) {
-	if m.Register != DoorStatusRegister || len(m.Data) != 10 {
-		return
+func (r *RegisterDoorStatus) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, DoorStatusRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 10); err != nil {
+		return err
 	}
 	r.Locked = m.Data[0] == 0x1
 	r.Driver = m.Data[3] == 0x1
@@ -570,6 +658,7 @@ func (r *RegisterDoorStatus) Decode(m *PhevMessage) {
 	r.Bonnet = m.Data[8] == 0x1
 	r.Headlights = m.Data[9] == 0x1
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterDoorStatus) Encode() *PhevMessage {
@@ -648,9 +737,12 @@ type RegisterChargeStatus struct {
 	raw       []byte
 }
 
-func (r *RegisterChargeStatus) Decode(m *PhevMessage) {
-	if m.Register != ChargeStatusRegister || len(m.Data) != 3 {
-		return
+func (r *RegisterChargeStatus) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, ChargeStatusRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 3); err != nil {
+		return err
 	}
 	r.Charging = m.Data[0] == 0x1
 	r.Remaining = 0
@@ -658,6 +750,7 @@ func (r *RegisterChargeStatus) Decode(m *PhevMessage) {
 		r.Remaining = int(m.Data[2])<<8 | int(m.Data[1])
 	}
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterChargeStatus) Encode() *PhevMessage {
@@ -674,7 +767,9 @@ func (r *RegisterChargeStatus) Encode() *PhevMessage {
 }
 
 func (r *RegisterACOperStatus) Encode() *PhevMessage {
-	data := make([]byte, 5)
+	lengths := acOperStatusLengths[r.year]
+	data := make([]byte, lengths[len(lengths)-1])
+	data[0] = byte(r.Ignition)
 	if r.Operating {
 		data[1] = 0x1
 	}
@@ -707,24 +802,55 @@ const (
 	PreACTerminated PreACState = 3
 )
 
+func (s PreACState) String() string {
+	switch s {
+	case PreACOff:
+		return "off"
+	case PreACOn:
+		return "on"
+	case PreACTerminated:
+		return "terminated"
+	default:
+		return fmt.Sprintf("unknown(%d)", int8(s))
+	}
+}
+
+func (s PreACState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// The pre-AC state data lengths by model year, either if unknown.
+var preACStateLengths = map[ModelYear][]int{
+	ModelYearUnknown: {1, 3},
+	ModelYear14:      {1},
+	ModelYear18:      {3},
+}
+
 type RegisterPreACState struct {
 	State PreACState
 	raw   []byte
+	// year selects the data length, see preACStateLengths.
+	year ModelYear
 }
 
 func (r *RegisterPreACState) Encode() *PhevMessage {
-	panic("unimplemented")
-	return nil
+	lengths := preACStateLengths[r.year]
+	data := make([]byte, lengths[len(lengths)-1])
+	data[0] = byte(r.State)
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
 }
 
-func (r *RegisterPreACState) Decode(m *PhevMessage) {
-	// MY'18 data length is 3 bytes, MY'14 uses 1 byte
+func (r *RegisterPreACState) Decode(m *PhevMessage) error {
 	// We only decode the operating state in 0th byte
-	if len(m.Data) < 1 {
-		return
+	if err := checkMinLength(m, preACStateLengths[r.year]...); err != nil {
+		return err
 	}
 	r.State = PreACState(m.Data[0])
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterPreACState) Raw() string {
@@ -740,7 +866,7 @@ func (r *RegisterPreACState) String() string {
 	case PreACTerminated:
 		return "Pre-AC terminated (door opened or battery low?)"
 	default:
-		return fmt.Sprintf("Pre-AC: unknown (%v)", r.State)
+		return fmt.Sprintf("Pre-AC: unknown (%d)", r.State)
 	}
 }
 
@@ -748,19 +874,59 @@ func (r *RegisterPreACState) Register() byte {
 	return PreACStateRegister
 }
 
+type IgnitionState int8
+
+const (
+	IgnitionOff IgnitionState = 0
+	IgnitionAcc IgnitionState = 3
+	IgnitionOn  IgnitionState = 4
+)
+
+func (s IgnitionState) String() string {
+	switch s {
+	case IgnitionOff:
+		return "off"
+	case IgnitionAcc:
+		return "acc"
+	case IgnitionOn:
+		return "on"
+	default:
+		return fmt.Sprintf("unknown(%d)", int8(s))
+	}
+}
+
+func (s IgnitionState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// The AC operating status data lengths by model year, either if
+// unknown.
+var acOperStatusLengths = map[ModelYear][]int{
+	ModelYearUnknown: {2, 5},
+	ModelYear14:      {2},
+	ModelYear18:      {5},
+}
+
 type RegisterACOperStatus struct {
+	Ignition  IgnitionState
 	Operating bool
 	raw       []byte
+	// year selects the data length, see acOperStatusLengths.
+	year ModelYear
 }
 
-func (r *RegisterACOperStatus) Decode(m *PhevMessage) {
-	// MY'18 data length is 5 bytes, MY'14 uses 2 bytes
-	// We only decode the operating state in byte 2
-	if m.Register != ACOperStatusRegister || len(m.Data) < 2 {
-		return
+func (r *RegisterACOperStatus) Decode(m *PhevMessage) error {
+	// We only decode the ignition in byte 1 and operating state in byte 2
+	if err := checkRegister(m, ACOperStatusRegister); err != nil {
+		return err
+	}
+	if err := checkMinLength(m, acOperStatusLengths[r.year]...); err != nil {
+		return err
 	}
+	r.Ignition = IgnitionState(m.Data[0])
 	r.Operating = m.Data[1] == 1
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterACOperStatus) Raw() string {
@@ -769,9 +935,9 @@ func (r *RegisterACOperStatus) Raw() string {
 
 func (r *RegisterACOperStatus) String() string {
 	if r.Operating {
-		return "AC on"
+		return fmt.Sprintf("AC on, ignition %s", r.Ignition)
 	}
-	return "AC off"
+	return fmt.Sprintf("AC off, ignition %s", r.Ignition)
 }
 
 func (r *RegisterACOperStatus) Register() byte {
@@ -784,9 +950,9 @@ type RegisterACMode struct {
 	raw      []byte
 }
 
-func (r *RegisterACMode) Decode(m *PhevMessage) {
-	if len(m.Data) != 1 {
-		return
+func (r *RegisterACMode) Decode(m *PhevMessage) error {
+	if err := checkLength(m, 1); err != nil {
+		return err
 	}
 	switch m.Data[0] & 0x0f {
 	case 0:
@@ -807,6 +973,7 @@ func (r *RegisterACMode) Decode(m *PhevMessage) {
 		r.Duration = 30
 	}
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterACMode) Encode() *PhevMessage {
@@ -821,6 +988,12 @@ func (r *RegisterACMode) Encode() *PhevMessage {
 	case "windscreen":
 		data = 0x3
 	}
+	switch r.Duration {
+	case 20:
+		data |= 0x10
+	case 30:
+		data |= 0x20
+	}
 	return &PhevMessage{
 		Register: r.Register(),
 		Data:     []byte{data},
@@ -844,12 +1017,13 @@ type RegisterChargePlug struct {
 	raw       []byte
 }
 
-func (r *RegisterChargePlug) Decode(m *PhevMessage) {
-	if len(m.Data) != 2 {
-		return
+func (r *RegisterChargePlug) Decode(m *PhevMessage) error {
+	if err := checkLength(m, 2); err != nil {
+		return err
 	}
 	r.Connected = (m.Data[1] == 1 || m.Data[0] > 0)
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterChargePlug) Encode() *PhevMessage {
@@ -883,9 +1057,12 @@ type RegisterWIFISSID struct {
 	raw  []byte
 }
 
-func (r *RegisterWIFISSID) Decode(m *PhevMessage) {
-	if m.Register != WIFISSIDRegister || len(m.Data) != 32 {
-		return
+func (r *RegisterWIFISSID) Decode(m *PhevMessage) error {
+	if err := checkRegister(m, WIFISSIDRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 32); err != nil {
+		return err
 	}
 	r.raw = []byte(m.Data)
 	r.raw = append([]byte{}, m.Data...)
@@ -896,6 +1073,7 @@ func (r *RegisterWIFISSID) Decode(m *PhevMessage) {
 		}
 	}
 	r.SSID = string(dat)
+	return nil
 }
 
 func (r *RegisterWIFISSID) Encode() *PhevMessage {
@@ -919,6 +1097,341 @@ func (r *RegisterWIFISSID) Register() byte {
 	return WIFISSIDRegister
 }
 
+// Weekdays is a bitmask of days, bit 0 is Sunday.
+type Weekdays byte
+
+var weekdayStr = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (w Weekdays) String() string {
+	days := []string{}
+	for i, d := range weekdayStr {
+		if w&(1<<i) != 0 {
+			days = append(days, d)
+		}
+	}
+	return strings.Join(days, ",")
+}
+
+// MarshalText encodes the days as in String().
+func (w Weekdays) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+// ParseWeekdays parses a comma separated list of days, as
+// returned by Weekdays.String().
+func ParseWeekdays(s string) (Weekdays, error) {
+	var w Weekdays
+	for _, d := range strings.Split(strings.ToLower(s), ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		found := false
+		for i, day := range weekdayStr {
+			if d == day {
+				w |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown day %q", d)
+		}
+	}
+	return w, nil
+}
+
+// TimerState is the state of a charge or climate timer.
+type TimerState byte
+
+const (
+	TimerEnabled  TimerState = 1
+	TimerDisabled TimerState = 2
+	TimerUnset    TimerState = 3
+)
+
+func (s TimerState) String() string {
+	switch s {
+	case TimerEnabled:
+		return "enabled"
+	case TimerDisabled:
+		return "disabled"
+	case TimerUnset:
+		return "unset"
+	default:
+		return fmt.Sprintf("unknown(%d)", s)
+	}
+}
+
+func (s TimerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ChargeTimer is a single charge timer slot. Minutes are in
+// multiples of 10.
+type ChargeTimer struct {
+	State       TimerState `json:"state"`
+	Days        Weekdays   `json:"days"`
+	StartHour   int        `json:"start_hour"`
+	StartMinute int        `json:"start_minute"`
+	StopHour    int        `json:"stop_hour"`
+	StopMinute  int        `json:"stop_minute"`
+	unknown     uint32
+}
+
+// Start returns the start time as HH:MM.
+func (t *ChargeTimer) Start() string {
+	return fmt.Sprintf("%02d:%02d", t.StartHour, t.StartMinute)
+}
+
+// Stop returns the stop time as HH:MM.
+func (t *ChargeTimer) Stop() string {
+	return fmt.Sprintf("%02d:%02d", t.StopHour, t.StopMinute)
+}
+
+// The 3 byte timer value is little endian, laid out as:
+// bits 0-6 weekdays, bit 7 unknown, 8-10 stop minute, 11-15 stop hour,
+// 16-18 start minute, 19-23 start hour.
+func (t *ChargeTimer) decode(data []byte) {
+	v := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+	t.Days = Weekdays(v & 0x7f)
+	t.unknown = v & 0x80
+	t.StopMinute = int((v>>8)&0x7) * 10
+	t.StopHour = int((v >> 11) & 0x1f)
+	t.StartMinute = int((v>>16)&0x7) * 10
+	t.StartHour = int((v >> 19) & 0x1f)
+	t.State = TimerState(data[3])
+}
+
+func (t *ChargeTimer) encode() []byte {
+	v := uint32(t.Days&0x7f) | t.unknown
+	v |= uint32(t.StopMinute/10&0x7) << 8
+	v |= uint32(t.StopHour&0x1f) << 11
+	v |= uint32(t.StartMinute/10&0x7) << 16
+	v |= uint32(t.StartHour&0x1f) << 19
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(t.State)}
+}
+
+func (t *ChargeTimer) String() string {
+	if t.State == TimerUnset {
+		return t.State.String()
+	}
+	return fmt.Sprintf("%s %s-%s [%s]", t.State, t.Start(), t.Stop(), t.Days)
+}
+
+type RegisterChargeTimer struct {
+	// Timers has the five charge timer slots. Empty on MY14 cars.
+	Timers []*ChargeTimer
+	raw    []byte
+}
+
+func (r *RegisterChargeTimer) Decode(m *PhevMessage) error {
+	// MY'18 data length is 20 bytes, MY'14 uses 1 byte which
+	// is not yet understood.
+	if err := checkRegister(m, ChargeTimerRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 20, 1); err != nil {
+		return err
+	}
+	r.raw = m.Data
+	r.Timers = nil
+	if len(m.Data) != 20 {
+		return nil
+	}
+	for i := 0; i < 20; i += 4 {
+		t := &ChargeTimer{}
+		t.decode(m.Data[i : i+4])
+		r.Timers = append(r.Timers, t)
+	}
+	return nil
+}
+
+func (r *RegisterChargeTimer) Encode() *PhevMessage {
+	data := []byte{}
+	for _, t := range r.Timers {
+		data = append(data, t.encode()...)
+	}
+	if len(r.Timers) == 0 {
+		data = r.raw
+	}
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
+}
+
+func (r *RegisterChargeTimer) Raw() string {
+	return hex.EncodeToString(r.raw)
+}
+
+func (r *RegisterChargeTimer) String() string {
+	if len(r.Timers) == 0 {
+		return fmt.Sprintf("Charge timers: unknown (%s)", r.Raw())
+	}
+	timers := []string{}
+	for i, t := range r.Timers {
+		timers = append(timers, fmt.Sprintf("%d: %s", i+1, t))
+	}
+	return "Charge timers: " + strings.Join(timers, "; ")
+}
+
+func (r *RegisterChargeTimer) Register() byte {
+	return ChargeTimerRegister
+}
+
+// ClimateTimer is a single climate timer slot. Minute is in
+// multiples of 10, Duration is 10, 20 or 30 minutes.
+type ClimateTimer struct {
+	State    TimerState `json:"state"`
+	Days     Weekdays   `json:"days"`
+	Hour     int        `json:"hour"`
+	Minute   int        `json:"minute"`
+	Duration int        `json:"duration"`
+	unknown  uint32
+}
+
+// Time returns the timer start time as HH:MM.
+func (t *ClimateTimer) Time() string {
+	return fmt.Sprintf("%02d:%02d", t.Hour, t.Minute)
+}
+
+// The 3 byte timer value is little endian, laid out as:
+// bits 0-1 duration, 2-8 weekdays, 9-11 minute, 12-16 hour,
+// 17-18 state, 19-23 unknown.
+func (t *ClimateTimer) decode(data []byte) {
+	v := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+	t.Duration = int(v&0x3+1) * 10
+	t.Days = Weekdays((v >> 2) & 0x7f)
+	t.Minute = int((v>>9)&0x7) * 10
+	t.Hour = int((v >> 12) & 0x1f)
+	t.State = TimerState((v >> 17) & 0x3)
+	t.unknown = v & 0xf80000
+}
+
+func (t *ClimateTimer) encode() []byte {
+	v := uint32(t.Duration/10-1) & 0x3
+	v |= uint32(t.Days&0x7f) << 2
+	v |= uint32(t.Minute/10&0x7) << 9
+	v |= uint32(t.Hour&0x1f) << 12
+	v |= uint32(t.State&0x3) << 17
+	v |= t.unknown
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func (t *ClimateTimer) String() string {
+	if t.State == TimerUnset {
+		return t.State.String()
+	}
+	return fmt.Sprintf("%s %s for %dmin [%s]", t.State, t.Time(), t.Duration, t.Days)
+}
+
+// NewClimateTimer returns an enabled climate timer.
+func NewClimateTimer(hour, minute, duration int, days Weekdays) (*ClimateTimer, error) {
+	switch {
+	case hour < 0 || hour > 23:
+		return nil, fmt.Errorf("invalid hour %d", hour)
+	case minute < 0 || minute > 50 || minute%10 != 0:
+		return nil, fmt.Errorf("invalid minute %d, must be a multiple of 10", minute)
+	case duration != 10 && duration != 20 && duration != 30:
+		return nil, fmt.Errorf("invalid duration %d, must be 10, 20 or 30", duration)
+	}
+	return &ClimateTimer{
+		State:    TimerEnabled,
+		Days:     days,
+		Hour:     hour,
+		Minute:   minute,
+		Duration: duration,
+	}, nil
+}
+
+// UnsetClimateTimer returns a climate timer slot with no schedule.
+func UnsetClimateTimer() *ClimateTimer {
+	t := &ClimateTimer{}
+	t.decode([]byte{0x00, 0xfe, 0x07})
+	return t
+}
+
+type RegisterClimateTimer struct {
+	// Timers has the five climate timer slots. Empty on MY14 cars.
+	Timers []*ClimateTimer
+	raw    []byte
+}
+
+func (r *RegisterClimateTimer) Decode(m *PhevMessage) error {
+	// MY'18 data length is 16 bytes, MY'14 uses 1 byte which
+	// is not yet understood.
+	if err := checkRegister(m, ClimateTimerRegister); err != nil {
+		return err
+	}
+	if err := checkLength(m, 16, 1); err != nil {
+		return err
+	}
+	r.raw = m.Data
+	r.Timers = nil
+	if len(m.Data) != 16 {
+		return nil
+	}
+	for i := 1; i < 16; i += 3 {
+		t := &ClimateTimer{}
+		t.decode(m.Data[i : i+3])
+		r.Timers = append(r.Timers, t)
+	}
+	return nil
+}
+
+func (r *RegisterClimateTimer) Encode() *PhevMessage {
+	if len(r.Timers) == 0 {
+		return &PhevMessage{
+			Register: r.Register(),
+			Data:     r.raw,
+		}
+	}
+	data := []byte{0x1}
+	if len(r.raw) > 0 {
+		data[0] = r.raw[0]
+	}
+	for _, t := range r.Timers {
+		data = append(data, t.encode()...)
+	}
+	return &PhevMessage{
+		Register: r.Register(),
+		Data:     data,
+	}
+}
+
+// SetPayload returns the data to write to SetClimateTimerRegister
+// to update the schedule to the current timers.
+func (r *RegisterClimateTimer) SetPayload() ([]byte, error) {
+	if len(r.Timers) != 5 {
+		return nil, fmt.Errorf("climate timers not supported")
+	}
+	data := []byte{}
+	for _, t := range r.Timers {
+		data = append(data, t.encode()...)
+	}
+	// Last byte is unknown, always seen as 0x1.
+	return append(data, 0x1), nil
+}
+
+func (r *RegisterClimateTimer) Raw() string {
+	return hex.EncodeToString(r.raw)
+}
+
+func (r *RegisterClimateTimer) String() string {
+	if len(r.Timers) == 0 {
+		return fmt.Sprintf("Climate timers: unknown (%s)", r.Raw())
+	}
+	timers := []string{}
+	for i, t := range r.Timers {
+		timers = append(timers, fmt.Sprintf("%d: %s", i+1, t))
+	}
+	return "Climate timers: " + strings.Join(timers, "; ")
+}
+
+func (r *RegisterClimateTimer) Register() byte {
+	return ClimateTimerRegister
+}
+
 func NewPingRequestMessage(id byte) *PhevMessage {
 	return NewMessage(CmdOutPingReq, id, false, []byte{0x0})
 }
@@ -947,17 +1460,17 @@ type RegisterLightStatus struct {
 
 func (r *RegisterLightStatus) Encode() *PhevMessage {
 	panic("unimplemented")
-	return nil
 }
 
-func (r *RegisterLightStatus) Decode(m *PhevMessage) {
-	if len(m.Data) != 5 {
-		return
+func (r *RegisterLightStatus) Decode(m *PhevMessage) error {
+	if err := checkLength(m, 5); err != nil {
+		return err
 	}
 	// Switches between 2 for Off and 1 for On.
 	r.Interior = m.Data[4]&0b11 == 1
 	r.Hazard = m.Data[3]&0b11 == 1
 	r.raw = m.Data
+	return nil
 }
 
 func (r *RegisterLightStatus) Raw() string {
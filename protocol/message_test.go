@@ -2,10 +2,18 @@ package protocol
 
 import (
 	"encoding/hex"
+	"errors"
 	"gopkg.in/d4l3k/messagediff.v1"
+	"os"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	// Fail on registers of unknown length.
+	SetStrict(true)
+	os.Exit(m.Run())
+}
+
 func TestDecodeEncodeBytes(t *testing.T) {
 	tests := []struct {
 		in   string
@@ -117,3 +125,149 @@ func TestDecodeEncodeBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterEncodeDecode(t *testing.T) {
+	tests := []struct {
+		register byte
+		in       string
+	}{
+		{BatteryLevelRegister, "50000100"},
+		{PreACStateRegister, "020000"},
+		{ACModeRegister, "12"},
+		{ACOperStatusRegister, "0401000000"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg := NewRegister(test.register)
+		if err := reg.Decode(&PhevMessage{Register: test.register, Data: data}); err != nil {
+			t.Fatalf("%s Decode(): %v", test.in, err)
+		}
+		if diff := hexCmp(reg.Encode().Data, test.in); diff != "" {
+			t.Errorf("%s Encode(): %s", reg, diff)
+		}
+	}
+}
+
+func TestRegisterChargeTimer(t *testing.T) {
+	in := "7d38b00183bd00017c70380100ffff0300ffff03"
+	data, err := hex.DecodeString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RegisterChargeTimer{}
+	if err := r.Decode(&PhevMessage{Register: ChargeTimerRegister, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.Timers), 5; got != want {
+		t.Fatalf("len(Timers) got=%d want=%d", got, want)
+	}
+	want := []string{
+		"enabled 22:00-07:00 [sun,tue,wed,thu,fri,sat]",
+		"enabled 00:00-23:50 [sun,mon]",
+		"enabled 07:00-14:00 [tue,wed,thu,fri,sat]",
+		"unset",
+		"unset",
+	}
+	for i, w := range want {
+		if got := r.Timers[i].String(); got != w {
+			t.Errorf("Timers[%d] got=%q want=%q", i, got, w)
+		}
+	}
+	if diff := hexCmp(r.Encode().Data, in); diff != "" {
+		t.Errorf("Encode(): %s", diff)
+	}
+}
+
+func TestRegisterClimateTimer(t *testing.T) {
+	in := "0204c00200fe0700fe0700fe0700fe07"
+	data, err := hex.DecodeString(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RegisterClimateTimer{}
+	if err := r.Decode(&PhevMessage{Register: ClimateTimerRegister, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r.Timers), 5; got != want {
+		t.Fatalf("len(Timers) got=%d want=%d", got, want)
+	}
+	if got, want := r.Timers[0].String(), "enabled 12:00 for 10min [sun]"; got != want {
+		t.Errorf("Timers[0] got=%q want=%q", got, want)
+	}
+	if got, want := r.Timers[1].String(), "unset"; got != want {
+		t.Errorf("Timers[1] got=%q want=%q", got, want)
+	}
+	if diff := hexCmp(r.Encode().Data, in); diff != "" {
+		t.Errorf("Encode(): %s", diff)
+	}
+
+	days, err := ParseWeekdays("sun,mon,tue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timers[1], err = NewClimateTimer(7, 50, 20, days)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := r.SetPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := hexCmp(payload, "04c0021d7a0200fe0700fe0700fe0701"); diff != "" {
+		t.Errorf("SetPayload(): %s", diff)
+	}
+}
+
+func TestRegisterDecodeErrors(t *testing.T) {
+	defer SetStrict(true)
+	tests := []struct {
+		register byte
+		in       string
+		strict   bool
+		wantErr  bool
+	}{
+		{BatteryLevelRegister, "50000100", true, false},
+		{BatteryLevelRegister, "50", false, true},
+		{BatteryLevelRegister, "5000010000", false, true},
+		{PreACStateRegister, "02", true, false},
+		{PreACStateRegister, "", false, true},
+		{PreACStateRegister, "02000000", false, false},
+		{PreACStateRegister, "02000000", true, true},
+		{ACOperStatusRegister, "040100", false, false},
+		{ACOperStatusRegister, "040100", true, true},
+		{ChargeTimerRegister, "00", true, false},
+		{ChargeTimerRegister, "0000", false, true},
+		{SettingsRegister, "023a003b003c0000", true, false},
+		{SettingsRegister, "023a003b003c00", false, true},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetStrict(test.strict)
+		msg := NewRegisterMessage(test.register, ModelYearUnknown, data)
+		if gotErr := msg.Err != nil; gotErr != test.wantErr {
+			t.Errorf("0x%02x %q strict=%t: Err got=%v wantErr=%t", test.register, test.in, test.strict, msg.Err, test.wantErr)
+			continue
+		}
+		if !test.wantErr {
+			continue
+		}
+		// Malformed registers keep their raw data.
+		if reg, ok := msg.Reg.(*RegisterGeneric); !ok || reg.Raw() != test.in {
+			t.Errorf("0x%02x %q: Reg got=%v want RegisterGeneric", test.register, test.in, msg.Reg)
+		}
+	}
+
+	var lerr *LengthError
+	if err := NewRegisterMessage(BatteryLevelRegister, ModelYearUnknown, []byte{0x50}).Err; !errors.As(err, &lerr) || lerr.Length != 1 {
+		t.Errorf("Err got=%v want LengthError", err)
+	}
+	if err := new(RegisterVIN).Decode(&PhevMessage{Register: DoorStatusRegister}); err == nil {
+		t.Errorf("Decode() of wrong register got=nil want error")
+	}
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ModelYear is a car model year, which changes the start messages
+// and some register layouts.
+type ModelYear int64
+
+const (
+	ModelYearUnknown ModelYear = iota
+	ModelYear14
+	ModelYear18
+	ModelYear24
+)
+
+func (y ModelYear) String() string {
+	switch y {
+	case ModelYear14:
+		return "MY14"
+	case ModelYear18:
+		return "MY18"
+	case ModelYear24:
+		return "MY24"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseModelYear parses a model year, e.g "MY18" or "18".
+func ParseModelYear(s string) (ModelYear, error) {
+	for _, y := range []ModelYear{ModelYear14, ModelYear18, ModelYear24} {
+		if name := y.String(); strings.EqualFold(s, name) || s == name[2:] {
+			return y, nil
+		}
+	}
+	return ModelYearUnknown, fmt.Errorf("unknown model year %q", s)
+}
+
+// StartModelYear returns the model year of a car start request
+// message type, or ModelYearUnknown for other types.
+func StartModelYear(msgType byte) ModelYear {
+	switch msgType {
+	case CmdInMy14StartReq:
+		return ModelYear14
+	case CmdInMy18StartReq:
+		return ModelYear18
+	case CmdInMy24StartReq:
+		return ModelYear24
+	default:
+		return ModelYearUnknown
+	}
+}
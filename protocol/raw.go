@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
+	"sync"
 )
 
 type SecurityState int
@@ -17,7 +18,13 @@ const (
 // SecurityKey implements the algorithm for the session encoding/decoding
 // keys.
 type SecurityKey struct {
-	State       SecurityState
+	State SecurityState
+	// ModelYear is from the car's start request, and selects the
+	// register codecs.
+	ModelYear ModelYear
+	// mu guards the keys, as connections decode and encode
+	// messages in separate goroutines.
+	mu          sync.Mutex
 	proposedKey []byte
 	securityKey byte
 	keyMap      []byte
@@ -25,16 +32,37 @@ type SecurityKey struct {
 }
 
 func (s *SecurityKey) GenerateProposal() []byte {
+	s.mu.Lock()
 	s.proposedKey = make([]byte, 8)
 	for i := 0; i < 8; i++ {
 		s.proposedKey[i] = byte(rand.Intn(256))
 	}
+	proposal := append([]byte{}, s.proposedKey...)
+	s.mu.Unlock()
 	s.State = SecurityKeyProposed
-	return s.proposedKey
+	return proposal
+}
+
+// Copy returns a copy of the key, to decode the other direction of a
+// connection with the same keys.
+func (s *SecurityKey) Copy() *SecurityKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &SecurityKey{
+		State:       s.State,
+		ModelYear:   s.ModelYear,
+		proposedKey: append([]byte{}, s.proposedKey...),
+		securityKey: s.securityKey,
+		keyMap:      append([]byte{}, s.keyMap...),
+		sNum:        s.sNum,
+		rNum:        s.rNum,
+	}
 }
 
 func (s *SecurityKey) AcceptProposal() {
-	s.Update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...))
+	s.mu.Lock()
+	s.update(append([]byte{0x0, 0x0, 0x0, 0x0}, s.proposedKey...))
+	s.mu.Unlock()
 	s.State = SecurityKeyAccepted
 }
 
@@ -44,6 +72,12 @@ func (s *SecurityKey) AcceptProposal() {
 // then from this security key a key map is generated, essentially
 // an array of session keys which are rotated through.
 func (s *SecurityKey) Update(packet []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(packet)
+}
+
+func (s *SecurityKey) update(packet []byte) {
 	if len(packet) < 12 {
 		s.keyMap = []byte{} // Clear security keys.
 		s.securityKey = 0x0
@@ -91,6 +125,8 @@ func (s *SecurityKey) Update(packet []byte) {
 // The returned value is XORed with the raw packet from the car before
 // decoding it.
 func (s *SecurityKey) RKey(increment bool) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.keyMap) == 0 {
 		log.Tracef("r_key=empty")
 		return 0
@@ -110,6 +146,8 @@ func (s *SecurityKey) RKey(increment bool) byte {
 // The returned value is XORed with the raw packet before sending
 // it to the car.
 func (s *SecurityKey) SKey(increment bool) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if len(s.keyMap) == 0 {
 		log.Tracef("s_key=empty")
 		return 0
@@ -131,14 +169,11 @@ func XorMessageWith(message []byte, xor byte) []byte {
 }
 
 func Checksum(message []byte) byte {
-	length := message[1] + 2
+	length := int(message[1]) + 2
 
 	b := byte(0)
-	for i := byte(0); ; i++ {
-		if i >= length-1 {
-			break
-		}
-		b = (byte)(message[i] + b)
+	for _, c := range message[:length-1] {
+		b += c
 	}
 	return b
 }
@@ -153,6 +188,64 @@ func ValidateChecksum(message []byte) bool {
 	return Checksum(message) == wantSum
 }
 
+const (
+	// The shortest message, with no data.
+	minMessageLength = 5
+	// The longest message, as the length byte excludes the type
+	// and length bytes.
+	maxMessageLength = 0xff + 2
+)
+
+// FindMessage finds the first valid message in data, which may start
+// or end with partial messages. It returns the message bounds, and ok
+// if a message is complete. If not ok, data[start:] may be the start
+// of a message, and more data is needed. Bytes before start are not
+// part of any message. A partial message of a known type is not
+// skipped for a later message, which may be inside it.
+func FindMessage(data []byte) (start, end int, ok bool) {
+	start, end, _, ok = findMessage(data)
+	return start, end, ok
+}
+
+// Like FindMessage, also returning the xor of the message.
+func findMessage(data []byte) (start, end int, xor byte, ok bool) {
+	for start = 0; len(data)-start >= 4; start++ {
+		end = 0
+		partial := false
+		// The ack byte is 0 or 1, so gives the xor, or near enough.
+		for _, x := range []byte{data[start+2], data[start+2] ^ 1} {
+			length := int(data[start+1]^x) + 2
+			if length < minMessageLength || length > maxMessageLength {
+				continue
+			}
+			if start+length > len(data) {
+				if _, ok := messageStr[data[start]^x]; ok {
+					partial = true
+				}
+				continue
+			}
+			if !ValidateChecksum(XorMessageWith(data[start:start+length], x)) {
+				continue
+			}
+			// Both xors can give a valid checksum, prefer a known type.
+			if _, ok := messageStr[data[start]^x]; ok {
+				return start, start + length, x, true
+			}
+			if end == 0 {
+				end = start + length
+				xor = x
+			}
+		}
+		if end > 0 {
+			return start, end, xor, true
+		}
+		if partial {
+			return start, 0, 0, false
+		}
+	}
+	return start, 0, 0, false
+}
+
 // Validate and decode message. Returns the decoded/validated message,
 // plus any trailing data.
 func ValidateAndDecodeMessage(message []byte) ([]byte, byte, []byte) {
@@ -161,3 +161,63 @@ func TestValidateAndDecodeMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestFindMessage(t *testing.T) {
+	tests := []struct {
+		in         string
+		start, end int
+		ok         bool
+	}{
+		// Complete message.
+		{in: "06f4f0f6f3f3", start: 0, end: 6, ok: true},
+		// Complete message with another following.
+		{in: "06f4f0f6f3f306f4f0f6f3f3", start: 0, end: 6, ok: true},
+		// Garbage before the message.
+		{in: "00112206f4f0f6f3f3", start: 3, end: 9, ok: true},
+		// Partial message.
+		{in: "06f4f0f6", start: 0, end: 0, ok: false},
+		// Too short to tell.
+		{in: "06f4", start: 0, end: 0, ok: false},
+		// Corrupted message, then another.
+		{in: "06f4f0f6f3f44ab8bd95bc98", start: 6, end: 12, ok: true},
+		// Corrupted message, then the start of a message of a
+		// known type.
+		{in: "06f4f0f6f3f4", start: 3, end: 0, ok: false},
+		// Partial message, not skipped for a message inside it.
+		{in: "6f0d00020001020306f4f0f6f3f3", start: 0, end: 0, ok: false},
+		// Ack message, which also has a valid checksum with the next
+		// byte and the other xor.
+		{in: "37c5c0d7c1d0e41613041203", start: 0, end: 6, ok: true},
+		// Long message.
+		{in: "ff879094eda82091132d9091ece0a891906f6f93906f6f93c8", start: 0, end: 25, ok: true},
+	}
+	for _, test := range tests {
+		in, err := hex.DecodeString(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, end, ok := FindMessage(in)
+		if start != test.start || end != test.end || ok != test.ok {
+			t.Errorf("FindMessage(%s) got=(%d, %d, %v) want=(%d, %d, %v)", test.in, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
+
+func TestFindMessagePartial(t *testing.T) {
+	for _, msg := range []string{
+		"06f4f0f6f3f3",
+		"ff879094eda82091132d9091ece0a891906f6f93906f6f93c8",
+		"6f0d000206f4f0f6f3f30000000044",
+	} {
+		data, err := hex.DecodeString(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// No message is found in the message as it arrives.
+		for n := 4; n < len(data); n++ {
+			if start, end, ok := FindMessage(data[:n]); ok || start != 0 {
+				t.Errorf("FindMessage(%x) got=(%d, %d, %v) want=(0, 0, false)", data[:n], start, end, ok)
+			}
+		}
+	}
+}
@@ -3,26 +3,131 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	//        log "github.com/sirupsen/logrus"
 )
 
+const (
+	// UpdateSettingRegister takes a setting id and value.
+	UpdateSettingRegister = 0x0f
+	// SaveSettingsRegister is set to 0x0 after updating settings.
+	SaveSettingsRegister = 0x0e
+)
+
+// A Setting is a single vehicle setting. Each 0x16 register carries
+// three settings, as (id, value) pairs. The top two bits of the id
+// byte are not part of the id, their meaning is unknown.
+type Setting struct {
+	ID    byte
+	Flags byte
+	// Value is as the car reports it, e.g 0x0e or 0x3e. This is not
+	// the value written to UpdateSettingRegister, e.g 0-4, and how
+	// they relate is not yet known.
+	Value byte
+}
+
+// Known setting ids, names are used for MQTT topics.
+var settingNames = map[byte]string{
+	0x07: "charge_light_cutout",
+	0x2a: "headlights_on_exit",
+	0x2b: "exterior_lights_on_unlock",
+}
+
+// The highest value written to UpdateSettingRegister for known
+// settings, e.g 4 for charge_light_cutout of off, 1, 2, 5 or 10 min.
+var settingMaxValues = map[byte]byte{
+	0x07: 4,
+	0x2a: 4,
+	0x2b: 2,
+}
+
+// CheckSettingValue returns an error if the value is not one written
+// to UpdateSettingRegister for the setting. Values of unknown settings
+// are not checked.
+func CheckSettingValue(id, value byte) error {
+	if max, ok := settingMaxValues[id]; ok && value > max {
+		return fmt.Errorf("%s: value %d out of range 0-%d", SettingName(id), value, max)
+	}
+	return nil
+}
+
+// Name returns a name for the setting, unknown settings are
+// named by their id, e.g "setting_3a".
+func (s Setting) Name() string {
+	return SettingName(s.ID)
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("%s(0x%02x)=%d flags=%d", s.Name(), s.ID, s.Value, s.Flags)
+}
+
+// SettingName returns the name of the setting with the given id.
+func SettingName(id byte) string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("setting_%02x", id)
+}
+
+// SettingID returns the id for the named setting, as returned
+// by SettingName.
+func SettingID(name string) (byte, error) {
+	for id, n := range settingNames {
+		if n == name {
+			return id, nil
+		}
+	}
+	var id byte
+	if _, err := fmt.Sscanf(name, "setting_%02x", &id); err != nil || id > 0x3f {
+		return 0, fmt.Errorf("unknown setting %q", name)
+	}
+	return id, nil
+}
+
+// DecodeSettings decodes the settings from a 0x16 register.
+func DecodeSettings(reg []byte) ([]Setting, error) {
+	switch {
+	case len(reg) != 8:
+		return nil, fmt.Errorf("register wrong length got=%d want=8", len(reg))
+	case reg[0] != 0x2:
+		return nil, fmt.Errorf("register must start with 0x2, is 0x%x", reg[0])
+	case reg[7] != 0x0:
+		return nil, fmt.Errorf("register must end with 0x0, is 0x%x", reg[7])
+	}
+	settings := []Setting{}
+	for i := 1; i < 7; i += 2 {
+		settings = append(settings, Setting{
+			ID:    reg[i] & 0x3f,
+			Flags: reg[i] >> 6,
+			Value: reg[i+1],
+		})
+	}
+	return settings, nil
+}
+
 // Vehicle settings are sent to the client in register 0x16.
 // The client sends updated settings to the vehicle via register 0x0f.
 type Settings struct {
+	mu       sync.Mutex
 	settings []uint64
+	values   map[byte]Setting
 }
 
-// FromRegister extracts settings from the 0x16 register. They appear
-// to be little endian and need decoding, though this is not yet certain.
+// FromRegister extracts settings from the 0x16 register.
 func (s *Settings) FromRegister(reg []byte) error {
-	switch {
-	case len(reg) != 8:
-		return fmt.Errorf("register wrong length got=%d want=8", len(reg))
-	case reg[0] != 0x2:
-		return fmt.Errorf("register must start with 0x2, is 0x%x", reg[0])
-	case reg[7] != 0x0:
-		return fmt.Errorf("register must end with 0x0, is 0x%x", reg[7])
+	decoded, err := DecodeSettings(reg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = map[byte]Setting{}
+	}
+	for _, setting := range decoded {
+		s.values[setting.ID] = setting
 	}
 	value := binary.LittleEndian.Uint64(reg)
 	for _, v := range s.settings {
@@ -34,18 +139,43 @@ func (s *Settings) FromRegister(reg []byte) error {
 	return nil
 }
 
+// Get returns the setting with the given id.
+func (s *Settings) Get(id byte) (Setting, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	setting, ok := s.values[id]
+	return setting, ok
+}
+
+// All returns all known settings, ordered by id.
+func (s *Settings) All() []Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Setting{}
+	for _, setting := range s.values {
+		ret = append(ret, setting)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
 func (s *Settings) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.settings = []uint64{}
+	s.values = map[byte]Setting{}
 }
 
 func (s *Settings) NewSender() *SettingsSender {
-	return &SettingsSender{settings: s.settings}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &SettingsSender{settings: append([]uint64{}, s.settings...)}
 }
 
 func (s *Settings) Dump() string {
 	ret := []string{}
-	for _, v := range s.settings {
-		ret = append(ret, fmt.Sprintf("%016x", v))
+	for _, setting := range s.All() {
+		ret = append(ret, setting.String())
 	}
 	return strings.Join(ret, "\n")
 }
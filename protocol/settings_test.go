@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeSettings(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Setting
+	}{
+		{
+			in: "026b0e2c002d0000",
+			want: []Setting{
+				{ID: 0x2b, Flags: 1, Value: 0x0e},
+				{ID: 0x2c, Flags: 0, Value: 0x00},
+				{ID: 0x2d, Flags: 0, Value: 0x00},
+			},
+		}, {
+			in: "02473ec81e093f00",
+			want: []Setting{
+				{ID: 0x07, Flags: 1, Value: 0x3e},
+				{ID: 0x08, Flags: 3, Value: 0x1e},
+				{ID: 0x09, Flags: 0, Value: 0x3f},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			data, err := hex.DecodeString(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecodeSettings(data)
+			if err != nil {
+				t.Fatalf("DecodeSettings() unexpected error: %v", err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("DecodeSettings() got=%v want=%v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("DecodeSettings()[%d] got=%v want=%v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSettingID(t *testing.T) {
+	for _, name := range []string{"headlights_on_exit", "setting_3a"} {
+		id, err := SettingID(name)
+		if err != nil {
+			t.Fatalf("SettingID(%q) unexpected error: %v", name, err)
+		}
+		if got := SettingName(id); got != name {
+			t.Errorf("SettingName(SettingID(%q)) got=%q", name, got)
+		}
+	}
+	if _, err := SettingID("bogus"); err == nil {
+		t.Errorf("SettingID(bogus) expected error")
+	}
+}
+
+func TestCheckSettingValue(t *testing.T) {
+	tests := []struct {
+		id, value byte
+		wantErr   bool
+	}{
+		{0x07, 4, false},
+		{0x07, 5, true},
+		{0x2b, 2, false},
+		{0x2b, 3, true},
+		{0x3a, 0xff, false},
+	}
+	for _, test := range tests {
+		if err := CheckSettingValue(test.id, test.value); (err != nil) != test.wantErr {
+			t.Errorf("CheckSettingValue(0x%02x, %d) got=%v wantErr=%t", test.id, test.value, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package session reads and writes recordings of the traffic between
+// a client and a Phev, as one JSON record per line.
+package session
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of traffic.
+const (
+	// In is from the car to the client.
+	In = "in"
+	// Out is from the client to the car.
+	Out = "out"
+)
+
+// A Record is data sent in one direction at a point in time.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Conn numbers the TCP connections in the session, from 1.
+	Conn int    `json:"conn"`
+	Dir  string `json:"dir"`
+	// Data is the data as sent over TCP, in hex.
+	Data string `json:"data"`
+}
+
+// NewRecord returns a record of the data.
+func NewRecord(t time.Time, conn int, dir string, data []byte) Record {
+	return Record{Time: t, Conn: conn, Dir: dir, Data: hex.EncodeToString(data)}
+}
+
+// Bytes returns the recorded data.
+func (r Record) Bytes() ([]byte, error) {
+	return hex.DecodeString(r.Data)
+}
+
+// A Writer writes records. It is safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// Write writes the record.
+func (w *Writer) Write(r Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(r)
+}
+
+// Read reads all records.
+func Read(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		rec := Record{}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if rec.Dir != In && rec.Dir != Out {
+			return nil, fmt.Errorf("line %d: bad direction %q", line, rec.Dir)
+		}
+		if _, err := rec.Bytes(); err != nil {
+			return nil, fmt.Errorf("line %d: bad data: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, s.Err()
+}
+
+// ReadFile reads all records from the file.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
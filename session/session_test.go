@@ -0,0 +1,42 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []Record{
+		NewRecord(start, 1, Out, []byte{0xf3, 0x04, 0x00, 0x0a, 0x00, 0x01}),
+		NewRecord(start.Add(time.Second), 1, In, []byte{0x3f, 0x04, 0x01, 0x0a, 0x00, 0x4e}),
+	}
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	for _, r := range want {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := Read(buf)
+	if err != nil {
+		t.Fatalf("Read() unexpected error: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Read() got=%v want=%v", got, want)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Conn != want[i].Conn || got[i].Dir != want[i].Dir || got[i].Data != want[i].Data {
+			t.Errorf("Read()[%d] got=%+v want=%+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := Read(strings.NewReader(`{"dir":"sideways","data":"00"}`)); err == nil {
+		t.Errorf("Read() bad direction: want error")
+	}
+	if _, err := Read(strings.NewReader(`{"dir":"in","data":"0g"}`)); err == nil {
+		t.Errorf("Read() bad data: want error")
+	}
+}
@@ -0,0 +1,310 @@
+// Package vehicle aggregates the registers received from a Phev
+// into a single view of the vehicle state.
+package vehicle
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+// Battery is the traction battery state.
+type Battery struct {
+	// Level is the charge level in percent.
+	Level int `json:"level"`
+	// Updated is when a good level was last reported.
+	Updated time.Time `json:"updated"`
+	Warning int       `json:"warning"`
+	// WarningUpdated is when the warning was last reported.
+	WarningUpdated time.Time `json:"warning_updated"`
+}
+
+// Charge is the charging state.
+type Charge struct {
+	Charging bool `json:"charging"`
+	// Remaining is the minutes of charging remaining.
+	Remaining int `json:"remaining"`
+	// RemainingUpdated is when a good remaining time was last reported.
+	RemainingUpdated time.Time `json:"remaining_updated"`
+	Updated          time.Time `json:"updated"`
+}
+
+// Plug is the charge plug state.
+type Plug struct {
+	Connected bool      `json:"connected"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Doors is the door and lock state. Doors are true if open.
+type Doors struct {
+	Locked         bool      `json:"locked"`
+	Driver         bool      `json:"driver"`
+	FrontPassenger bool      `json:"front_passenger"`
+	RearLeft       bool      `json:"rear_left"`
+	RearRight      bool      `json:"rear_right"`
+	Bonnet         bool      `json:"bonnet"`
+	Boot           bool      `json:"boot"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Lights is the state of the lights, which the car reports
+// across several registers.
+type Lights struct {
+	Head     bool      `json:"head"`
+	Parking  bool      `json:"parking"`
+	Interior bool      `json:"interior"`
+	Hazard   bool      `json:"hazard"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Climate is the climate control state. The car sends the state
+// and mode in separate registers.
+type Climate struct {
+	State protocol.PreACState `json:"state"`
+	// Mode is e.g "heat", empty if not yet known.
+	Mode      string    `json:"mode"`
+	Duration  int       `json:"duration"`
+	Operating bool      `json:"operating"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Ignition is the ignition state.
+type Ignition struct {
+	State   protocol.IgnitionState `json:"state"`
+	Updated time.Time              `json:"updated"`
+}
+
+// Timers are the charge and climate timer schedules.
+type Timers struct {
+	Charge  []protocol.ChargeTimer  `json:"charge"`
+	Climate []protocol.ClimateTimer `json:"climate"`
+	Updated time.Time               `json:"updated"`
+}
+
+// VehicleState is a snapshot of the vehicle state. Sections are
+// not known until their Updated time is set.
+type VehicleState struct {
+	VIN           string    `json:"vin"`
+	Registrations int       `json:"registrations"`
+	ECUVersion    string    `json:"ecu_version"`
+	Battery       Battery   `json:"battery"`
+	Charge        Charge    `json:"charge"`
+	Plug          Plug      `json:"plug"`
+	Doors         Doors     `json:"doors"`
+	Lights        Lights    `json:"lights"`
+	Climate       Climate   `json:"climate"`
+	Ignition      Ignition  `json:"ignition"`
+	Timers        Timers    `json:"timers"`
+	Updated       time.Time `json:"updated"`
+}
+
+// A Change is sent to subscribers when a register changes value.
+type Change struct {
+	Register byte
+	// Old is nil the first time the register is received.
+	Old, New []byte
+	State    VehicleState
+}
+
+// A Subscription receives vehicle state changes.
+type Subscription struct {
+	C chan Change
+}
+
+// Vehicle tracks the vehicle state. It is safe for concurrent use.
+type Vehicle struct {
+	mu        sync.Mutex
+	state     VehicleState
+	raw       map[byte][]byte
+	registers map[byte]protocol.Register
+	subs      []*Subscription
+}
+
+// New returns a Vehicle with no known state.
+func New() *Vehicle {
+	return &Vehicle{
+		raw:       map[byte][]byte{},
+		registers: map[byte]protocol.Register{},
+	}
+}
+
+// Update updates the state from a message from the car. Only register
+// updates are used, other messages and malformed registers are
+// ignored. Returns true if the register changed value.
+func (v *Vehicle) Update(msg *protocol.PhevMessage) bool {
+	return v.UpdateAt(msg, time.Now())
+}
+
+// UpdateAt is like Update, for a message received at the given time,
+// e.g when restoring state.
+func (v *Vehicle) UpdateAt(msg *protocol.PhevMessage, now time.Time) bool {
+	if msg.Type != protocol.CmdInResp || msg.Ack != protocol.Request || msg.Reg == nil || msg.Err != nil {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	old, seen := v.raw[msg.Register]
+	v.raw[msg.Register] = append([]byte{}, msg.Data...)
+	v.registers[msg.Register] = msg.Reg
+	v.apply(msg.Reg, now)
+	v.state.Updated = now
+	if seen && bytes.Equal(old, msg.Data) {
+		return false
+	}
+	change := Change{
+		Register: msg.Register,
+		Old:      old,
+		New:      v.raw[msg.Register],
+		State:    v.state.copy(),
+	}
+	for _, s := range v.subs {
+		select {
+		case s.C <- change:
+		default:
+		}
+	}
+	return true
+}
+
+func (v *Vehicle) apply(reg protocol.Register, now time.Time) {
+	s := &v.state
+	switch r := reg.(type) {
+	case *protocol.RegisterVIN:
+		s.VIN = r.VIN
+		s.Registrations = r.Registrations
+	case *protocol.RegisterECUVersion:
+		s.ECUVersion = r.Version
+	case *protocol.RegisterBatteryLevel:
+		// The car sometimes reports bogus levels, keep the last good one.
+		if r.Level > 5 && r.Level < 255 {
+			s.Battery.Level = r.Level
+			s.Battery.Updated = now
+		}
+		s.Lights.Parking = r.ParkingLights
+		s.Lights.Updated = now
+	case *protocol.RegisterBatteryWarning:
+		s.Battery.Warning = r.Warning
+		s.Battery.WarningUpdated = now
+	case *protocol.RegisterChargeStatus:
+		s.Charge.Charging = r.Charging
+		// Likewise for implausible charge times.
+		if r.Remaining < 1000 {
+			s.Charge.Remaining = r.Remaining
+			s.Charge.RemainingUpdated = now
+		}
+		s.Charge.Updated = now
+	case *protocol.RegisterChargePlug:
+		s.Plug.Connected = r.Connected
+		s.Plug.Updated = now
+	case *protocol.RegisterDoorStatus:
+		s.Doors = Doors{
+			Locked:         r.Locked,
+			Driver:         r.Driver,
+			FrontPassenger: r.FrontPassenger,
+			RearLeft:       r.RearLeft,
+			RearRight:      r.RearRight,
+			Bonnet:         r.Bonnet,
+			Boot:           r.Boot,
+			Updated:        now,
+		}
+		s.Lights.Head = r.Headlights
+		s.Lights.Updated = now
+	case *protocol.RegisterLightStatus:
+		s.Lights.Interior = r.Interior
+		s.Lights.Hazard = r.Hazard
+		s.Lights.Updated = now
+	case *protocol.RegisterPreACState:
+		s.Climate.State = r.State
+		s.Climate.Updated = now
+	case *protocol.RegisterACMode:
+		s.Climate.Mode = r.Mode
+		s.Climate.Duration = int(r.Duration)
+		s.Climate.Updated = now
+	case *protocol.RegisterACOperStatus:
+		s.Climate.Operating = r.Operating
+		s.Climate.Updated = now
+		s.Ignition.State = r.Ignition
+		s.Ignition.Updated = now
+	case *protocol.RegisterChargeTimer:
+		s.Timers.Charge = nil
+		for _, t := range r.Timers {
+			s.Timers.Charge = append(s.Timers.Charge, *t)
+		}
+		s.Timers.Updated = now
+	case *protocol.RegisterClimateTimer:
+		s.Timers.Climate = nil
+		for _, t := range r.Timers {
+			s.Timers.Climate = append(s.Timers.Climate, *t)
+		}
+		s.Timers.Updated = now
+	}
+}
+
+// Returns a copy not sharing any slices with s.
+func (s VehicleState) copy() VehicleState {
+	s.Timers.Charge = append([]protocol.ChargeTimer(nil), s.Timers.Charge...)
+	s.Timers.Climate = append([]protocol.ClimateTimer(nil), s.Timers.Climate...)
+	return s
+}
+
+// State returns a snapshot of the current state.
+func (v *Vehicle) State() VehicleState {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.state.copy()
+}
+
+// Register returns the last received value of the register,
+// or nil if not yet received.
+func (v *Vehicle) Register(register byte) protocol.Register {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.registers[register]
+}
+
+// Raw returns the last received data of the register, or nil
+// if not yet received.
+func (v *Vehicle) Raw(register byte) []byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if data, ok := v.raw[register]; ok {
+		return append([]byte{}, data...)
+	}
+	return nil
+}
+
+// Registers returns the last received data of all registers.
+func (v *Vehicle) Registers() map[byte][]byte {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	regs := map[byte][]byte{}
+	for r, data := range v.raw {
+		regs[r] = append([]byte{}, data...)
+	}
+	return regs
+}
+
+// Subscribe returns a subscription receiving register changes.
+// Changes are dropped if the subscriber does not keep up.
+func (v *Vehicle) Subscribe() *Subscription {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := &Subscription{C: make(chan Change, 10)}
+	v.subs = append(v.subs, s)
+	return s
+}
+
+// Unsubscribe stops sending changes to the subscription.
+func (v *Vehicle) Unsubscribe(s *Subscription) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	subs := []*Subscription{}
+	for _, sub := range v.subs {
+		if sub != s {
+			subs = append(subs, sub)
+		}
+	}
+	v.subs = subs
+}
@@ -0,0 +1,92 @@
+package vehicle
+
+import (
+	"testing"
+
+	"github.com/buxtronix/phev2mqtt/protocol"
+)
+
+func registerMessage(t *testing.T, reg protocol.Register, register byte, data []byte) *protocol.PhevMessage {
+	t.Helper()
+	msg := &protocol.PhevMessage{
+		Type:     protocol.CmdInResp,
+		Ack:      protocol.Request,
+		Register: register,
+		Data:     data,
+	}
+	if err := reg.Decode(msg); err != nil {
+		t.Fatalf("Decode(): %v", err)
+	}
+	msg.Reg = reg
+	return msg
+}
+
+func TestUpdate(t *testing.T) {
+	v := New()
+	sub := v.Subscribe()
+
+	if !v.Update(registerMessage(t, &protocol.RegisterBatteryLevel{}, protocol.BatteryLevelRegister, []byte{0x50, 0x0, 0x1, 0x0})) {
+		t.Errorf("Update() of new register got=false want=true")
+	}
+	// A bogus level keeps the last good one.
+	if !v.Update(registerMessage(t, &protocol.RegisterBatteryLevel{}, protocol.BatteryLevelRegister, []byte{0xff, 0x0, 0x0, 0x0})) {
+		t.Errorf("Update() of changed register got=false want=true")
+	}
+	if v.Update(registerMessage(t, &protocol.RegisterBatteryLevel{}, protocol.BatteryLevelRegister, []byte{0xff, 0x0, 0x0, 0x0})) {
+		t.Errorf("Update() of unchanged register got=true want=false")
+	}
+	// Malformed registers are ignored.
+	if v.Update(protocol.NewRegisterMessage(protocol.BatteryLevelRegister, protocol.ModelYearUnknown, []byte{0x0})) {
+		t.Errorf("Update() of malformed register got=true want=false")
+	}
+	s := v.State()
+	if s.Battery.Level != 0x50 {
+		t.Errorf("Battery.Level got=%d want=%d", s.Battery.Level, 0x50)
+	}
+	if s.Lights.Parking {
+		t.Errorf("Lights.Parking got=true want=false")
+	}
+
+	if got := len(sub.C); got != 2 {
+		t.Fatalf("subscription got %d changes want 2", got)
+	}
+	c := <-sub.C
+	if c.Old != nil || c.State.Battery.Level != 0x50 || !c.State.Lights.Parking {
+		t.Errorf("first change got=%+v", c)
+	}
+
+	v.Unsubscribe(sub)
+	v.Update(registerMessage(t, &protocol.RegisterDoorStatus{}, protocol.DoorStatusRegister, make([]byte, 10)))
+	if got := len(sub.C); got != 1 {
+		t.Errorf("unsubscribed got %d changes want 1", got)
+	}
+}
+
+func TestBatteryWarning(t *testing.T) {
+	v := New()
+	v.Update(registerMessage(t, &protocol.RegisterBatteryWarning{}, protocol.BatteryWarningRegister, []byte{0x0, 0x0, 0x1, 0x0}))
+	// A bogus level after a warning is still not a good level.
+	v.Update(registerMessage(t, &protocol.RegisterBatteryLevel{}, protocol.BatteryLevelRegister, []byte{0xff, 0x0, 0x0, 0x0}))
+	s := v.State()
+	if s.Battery.Warning != 1 || s.Battery.WarningUpdated.IsZero() {
+		t.Errorf("Battery warning got=%d updated=%v want=1 and set", s.Battery.Warning, s.Battery.WarningUpdated)
+	}
+	if !s.Battery.Updated.IsZero() {
+		t.Errorf("Battery.Updated got=%v want zero", s.Battery.Updated)
+	}
+}
+
+func TestChargeRemaining(t *testing.T) {
+	v := New()
+	// An implausible time is not a good one.
+	v.Update(registerMessage(t, &protocol.RegisterChargeStatus{}, protocol.ChargeStatusRegister, []byte{0x1, 0xff, 0x7f}))
+	s := v.State()
+	if !s.Charge.Charging || !s.Charge.RemainingUpdated.IsZero() {
+		t.Errorf("Charge got charging=%v remaining updated=%v want true and zero", s.Charge.Charging, s.Charge.RemainingUpdated)
+	}
+	v.Update(registerMessage(t, &protocol.RegisterChargeStatus{}, protocol.ChargeStatusRegister, []byte{0x1, 0x5a, 0x0}))
+	s = v.State()
+	if s.Charge.Remaining != 90 || s.Charge.RemainingUpdated.IsZero() {
+		t.Errorf("Charge.Remaining got=%d updated=%v want=90 and set", s.Charge.Remaining, s.Charge.RemainingUpdated)
+	}
+}